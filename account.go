@@ -20,74 +20,71 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwallet/chain"
 	"github.com/conformal/btcwallet/tx"
 	"github.com/conformal/btcwallet/wallet"
+	"github.com/conformal/btcwallet/wallet/hdaccount"
+	"github.com/conformal/btcwallet/wallet/psbt"
+	"github.com/conformal/btcwallet/wallet/txauthor"
+	"github.com/conformal/btcwallet/wallet/txsigner"
+	"github.com/conformal/btcwallet/wtxmgr"
 	"github.com/conformal/btcwire"
 	"path/filepath"
-	"sync"
 )
 
 // ErrNotFound describes an error where a map lookup failed due to a
 // key not being in the map.
 var ErrNotFound = errors.New("not found")
 
-// addressAccountMap holds a map of addresses to names of the
-// accounts that hold each address.
-var addressAccountMap = struct {
-	sync.RWMutex
-	m map[string]string
-}{
-	m: make(map[string]string),
-}
-
-// MarkAddressForAccount marks an address as belonging to an account.
-func MarkAddressForAccount(address, account string) {
-	addressAccountMap.Lock()
-	addressAccountMap.m[address] = account
-	addressAccountMap.Unlock()
-}
-
-// LookupAccountByAddress returns the account name for address.  error
-// will be set to ErrNotFound if the address has not been marked as
-// associated with any account.
-func LookupAccountByAddress(address string) (string, error) {
-	addressAccountMap.RLock()
-	defer addressAccountMap.RUnlock()
-	account, ok := addressAccountMap.m[address]
-	if !ok {
-		return "", ErrNotFound
-	}
-	return account, nil
-}
-
 // Account is a structure containing all the components for a
 // complete wallet.  It contains the Armory-style wallet (to store
-// addresses and keys), and tx and utxo data stores, along with locks
-// to prevent against incorrect multiple access.
+// addresses and keys), and tx and utxo data stores.
+//
+// Account values are never accessed concurrently: every field is
+// owned by, and may only be touched from, the AccountManager goroutine
+// that registered the account (see AccountManager.AddAccount).  This
+// replaces the previous per-Account mtx/UtxoStore/TxStore mutex
+// triplet, which was prone to lock-ordering mistakes (see the history
+// of ImportWIFPrivateKey) now that every RPC-facing read or write is
+// funneled through a manager request instead of locking directly.
 type Account struct {
 	*wallet.Wallet
-	mtx        sync.RWMutex
+	mgr        *AccountManager
+	chainSvc   chain.Interface
 	name       string
 	dirty      bool
 	fullRescan bool
-	UtxoStore  struct {
-		sync.RWMutex
-		dirty bool
-		s     tx.UtxoStore
-	}
-	TxStore struct {
-		sync.RWMutex
-		dirty bool
-		s     tx.TxStore
-	}
+
+	// Store indexes every recorded transaction and credit for this
+	// account.  It replaces the old slice-backed tx.TxStore/
+	// tx.UtxoStore pair, which required a linear scan for every
+	// address, balance, or history lookup.
+	Store      *wtxmgr.Store
+	storeDirty bool
+
+	// hd is the BIP44 external/internal chain pair backing this
+	// account when it was derived from a seed.  It is nil for an
+	// account wrapping a legacy, pre-HD Armory wallet (see
+	// AccountManager.WrapLegacyAccount), which has no change chain
+	// and continues to derive every address, including change, from
+	// the embedded *wallet.Wallet's single chain.
+	hd            *hdaccount.Account
+	externalIndex uint32
+	internalIndex uint32
+}
+
+// SetChainSvc sets the chain backend an account uses to request
+// notifications and rescans.  It must be called once, before the
+// account is registered with an AccountManager.
+func (a *Account) SetChainSvc(chainSvc chain.Interface) {
+	a.chainSvc = chainSvc
 }
 
 // Lock locks the underlying wallet for an account.
 func (a *Account) Lock() error {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
-
 	err := a.Wallet.Lock()
 	if err == nil {
 		NotifyWalletLockStateChange(a.Name(), true)
@@ -97,9 +94,6 @@ func (a *Account) Lock() error {
 
 // Unlock unlocks the underlying wallet for an account.
 func (a *Account) Unlock(passphrase []byte, timeout int64) error {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
-
 	err := a.Wallet.Unlock(passphrase)
 	if err == nil {
 		NotifyWalletLockStateChange(a.Name(), false)
@@ -112,13 +106,15 @@ func (a *Account) Unlock(passphrase []byte, timeout int64) error {
 // chain.  This is used to remove transactions and utxos for each wallet
 // that occured on a chain no longer considered to be the main chain.
 func (a *Account) Rollback(height int32, hash *btcwire.ShaHash) {
-	a.UtxoStore.Lock()
-	a.UtxoStore.dirty = a.UtxoStore.dirty || a.UtxoStore.s.Rollback(height, hash)
-	a.UtxoStore.Unlock()
-
-	a.TxStore.Lock()
-	a.TxStore.dirty = a.TxStore.dirty || a.TxStore.s.Rollback(height, hash)
-	a.TxStore.Unlock()
+	changed, restored := a.Store.Rollback(height, hash)
+	if changed {
+		a.storeDirty = true
+		notifier := a.mgr.Notifier()
+		for _, out := range restored {
+			notifier.NotifySpentness(out, false)
+		}
+		notifier.NotifyAccountBalance(a.name, a.CalculateBalance(0), false)
+	}
 
 	if err := a.writeDirtyToDisk(); err != nil {
 		log.Errorf("cannot sync dirty wallet: %v", err)
@@ -126,30 +122,12 @@ func (a *Account) Rollback(height int32, hash *btcwire.ShaHash) {
 }
 
 // AddressUsed returns whether there are any recorded transactions spending to
-// a given address.  Assumming correct TxStore usage, this will return true iff
+// a given address.  Assumming correct Store usage, this will return true iff
 // there are any transactions with outputs to this address in the blockchain or
-// the btcd mempool.
+// the btcd mempool.  This is an O(1) index lookup rather than a scan of
+// every recorded transaction.
 func (a *Account) AddressUsed(addr btcutil.Address) bool {
-	// This can be optimized by recording this data as it is read when
-	// opening an account, and keeping it up to date each time a new
-	// received tx arrives.
-
-	a.TxStore.RLock()
-	defer a.TxStore.RUnlock()
-
-	pkHash := addr.ScriptAddress()
-
-	for i := range a.TxStore.s {
-		rtx, ok := a.TxStore.s[i].(*tx.RecvTx)
-		if !ok {
-			continue
-		}
-
-		if bytes.Equal(rtx.ReceiverHash, pkHash) {
-			return true
-		}
-	}
-	return false
+	return a.Store.AddressUsed(addr)
 }
 
 // CalculateBalance sums the amounts of all unspent transaction
@@ -162,22 +140,12 @@ func (a *Account) AddressUsed(addr btcutil.Address) bool {
 // the balance will be calculated based on how many how many blocks
 // include a UTXO.
 func (a *Account) CalculateBalance(confirms int) float64 {
-	var bal uint64 // Measured in satoshi
-
 	bs, err := GetCurBlock()
 	if bs.Height == int32(btcutil.BlockHeightUnknown) || err != nil {
 		return 0.
 	}
 
-	a.UtxoStore.RLock()
-	for _, u := range a.UtxoStore.s {
-		// Utxos not yet in blocks (height -1) should only be
-		// added if confirmations is 0.
-		if confirms == 0 || (u.Height != -1 && int(bs.Height-u.Height+1) >= confirms) {
-			bal += u.Amt
-		}
-	}
-	a.UtxoStore.RUnlock()
+	bal := a.Store.Balance(confirms, bs.Height)
 	return float64(bal) / float64(btcutil.SatoshiPerBitcoin)
 }
 
@@ -191,24 +159,12 @@ func (a *Account) CalculateBalance(confirms int) float64 {
 // the balance will be calculated based on how many how many blocks
 // include a UTXO.
 func (a *Account) CalculateAddressBalance(addr *btcutil.AddressPubKeyHash, confirms int) float64 {
-	var bal uint64 // Measured in satoshi
-
 	bs, err := GetCurBlock()
 	if bs.Height == int32(btcutil.BlockHeightUnknown) || err != nil {
 		return 0.
 	}
 
-	a.UtxoStore.RLock()
-	for _, u := range a.UtxoStore.s {
-		// Utxos not yet in blocks (height -1) should only be
-		// added if confirmations is 0.
-		if confirms == 0 || (u.Height != -1 && int(bs.Height-u.Height+1) >= confirms) {
-			if bytes.Equal(addr.ScriptAddress(), u.AddrHash[:]) {
-				bal += u.Amt
-			}
-		}
-	}
-	a.UtxoStore.RUnlock()
+	bal := a.Store.AddressBalance(addr, confirms, bs.Height)
 	return float64(bal) / float64(btcutil.SatoshiPerBitcoin)
 }
 
@@ -217,9 +173,23 @@ func (a *Account) CalculateAddressBalance(addr *btcutil.AddressPubKeyHash, confi
 // one transaction spending to it in the blockchain or btcd mempool), the next
 // chained address is returned.
 func (a *Account) CurrentAddress() (btcutil.Address, error) {
-	a.mtx.RLock()
+	if a.hd != nil {
+		// externalIndex is the next index NewAddress will derive, so
+		// the most recently requested address is the one before it.
+		if a.externalIndex == 0 {
+			return a.NewAddress()
+		}
+		addr, err := a.hd.ExternalAddress(a.externalIndex-1, a.Net())
+		if err != nil {
+			return nil, err
+		}
+		if a.AddressUsed(addr) {
+			return a.NewAddress()
+		}
+		return addr, nil
+	}
+
 	addr := a.Wallet.LastChainedAddress()
-	a.mtx.RUnlock()
 
 	// Get next chained address if the last one has already been used.
 	if a.AddressUsed(addr) {
@@ -231,7 +201,8 @@ func (a *Account) CurrentAddress() (btcutil.Address, error) {
 
 // ListTransactions returns a slice of maps with details about a recorded
 // transaction.  This is intended to be used for listtransactions RPC
-// replies.
+// replies.  from and count are honored as a proper reverse-range cursor
+// over the indexed Store, rather than tail-slicing a flat slice.
 func (a *Account) ListTransactions(from, count int) ([]map[string]interface{}, error) {
 	// Get current block.  The block height used for calculating
 	// the number of tx confirmations.
@@ -241,13 +212,8 @@ func (a *Account) ListTransactions(from, count int) ([]map[string]interface{}, e
 	}
 
 	var txInfoList []map[string]interface{}
-	a.mtx.RLock()
-	a.TxStore.RLock()
-
-	lastLookupIdx := len(a.TxStore.s) - count
-	// Search in reverse order: lookup most recently-added first.
-	for i := len(a.TxStore.s) - 1; i >= from && i >= lastLookupIdx; i-- {
-		switch e := a.TxStore.s[i].(type) {
+	for _, key := range a.Store.ListTransactions(from, count) {
+		switch e := a.Store.Record(key).(type) {
 		case *tx.SendTx:
 			infos := e.TxInfo(a.name, bs.Height, a.Net())
 			txInfoList = append(txInfoList, infos...)
@@ -257,8 +223,6 @@ func (a *Account) ListTransactions(from, count int) ([]map[string]interface{}, e
 			txInfoList = append(txInfoList, info)
 		}
 	}
-	a.mtx.RUnlock()
-	a.TxStore.RUnlock()
 
 	return txInfoList, nil
 }
@@ -277,21 +241,16 @@ func (a *Account) ListAddressTransactions(pkHashes map[string]struct{}) (
 	}
 
 	var txInfoList []map[string]interface{}
-	a.mtx.RLock()
-	a.TxStore.RLock()
-
-	for i := range a.TxStore.s {
-		rtx, ok := a.TxStore.s[i].(*tx.RecvTx)
-		if !ok {
+	for _, info := range a.ActiveAddresses() {
+		addr := info.Address
+		if _, ok := pkHashes[string(addr.ScriptAddress())]; !ok {
 			continue
 		}
-		if _, ok := pkHashes[string(rtx.ReceiverHash[:])]; ok {
+		for _, rtx := range a.Store.RecordsForAddress(addr) {
 			info := rtx.TxInfo(a.name, bs.Height, a.Net())
 			txInfoList = append(txInfoList, info)
 		}
 	}
-	a.mtx.RUnlock()
-	a.TxStore.RUnlock()
 
 	return txInfoList, nil
 }
@@ -308,12 +267,9 @@ func (a *Account) ListAllTransactions() ([]map[string]interface{}, error) {
 	}
 
 	var txInfoList []map[string]interface{}
-	a.mtx.RLock()
-	a.TxStore.RLock()
-
 	// Search in reverse order: lookup most recently-added first.
-	for i := len(a.TxStore.s) - 1; i >= 0; i-- {
-		switch e := a.TxStore.s[i].(type) {
+	for _, key := range a.Store.ListTransactions(0, 0) {
+		switch e := a.Store.Record(key).(type) {
 		case *tx.SendTx:
 			infos := e.TxInfo(a.name, bs.Height, a.Net())
 			txInfoList = append(txInfoList, infos...)
@@ -323,18 +279,136 @@ func (a *Account) ListAllTransactions() ([]map[string]interface{}, error) {
 			txInfoList = append(txInfoList, info)
 		}
 	}
-	a.mtx.RUnlock()
-	a.TxStore.RUnlock()
 
 	return txInfoList, nil
 }
 
+// SendOutputs authors, signs, and returns a transaction paying outputs
+// at feeRatePerKB, selecting inputs from the account's unspent
+// credits with at least minConf confirmations using strategy.  Change,
+// if any, is sent to a freshly derived address from this account.
+// Signing looks keys up through keyDB, so an input paying to an address
+// derived from an hd chain cannot be signed and an error is returned.
+func (a *Account) SendOutputs(outputs []*btcwire.TxOut, feeRatePerKB uint64,
+	minConf int, strategy txauthor.CoinSelectionStrategy) (*btcwire.MsgTx, error) {
+
+	bs, err := GetCurBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	authored, err := txauthor.NewUnsignedTransaction(outputs, feeRatePerKB,
+		a.Store.Credits(), minConf, bs.Height, strategy, a.changeSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := txsigner.SignCredits(authored.Tx, authored.SelectedUtxos, a.keyDB()); err != nil {
+		return nil, err
+	}
+
+	return authored.Tx, nil
+}
+
+// changeSource derives a fresh change address and returns its
+// pay-to-address script, for use as a txauthor.NewUnsignedTransaction
+// change source.  An HD account sends change to its internal (change)
+// chain via NewChangeAddress; a legacy account has no such chain and
+// uses NewAddress instead, matching its previous behavior.
+func (a *Account) changeSource() ([]byte, error) {
+	var addr btcutil.Address
+	var err error
+	if a.hd != nil {
+		addr, err = a.NewChangeAddress()
+	} else {
+		addr, err = a.NewAddress()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return btcscript.PayToAddrScript(addr)
+}
+
+// CreatePSBT authors (but does not sign) a transaction paying outputs
+// at feeRatePerKB with at least minConf confirmations, and returns it
+// encoded as BIP-174 PSBT bytes for offline or hardware-wallet
+// signing.  Each selected credit's originating transaction is included
+// as its input's non-witness UTXO, so the packet can round-trip
+// through SignPSBT.
+func (a *Account) CreatePSBT(outputs []*btcwire.TxOut, feeRatePerKB uint64,
+	minConf int) ([]byte, error) {
+
+	bs, err := GetCurBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	authored, err := txauthor.NewUnsignedTransaction(outputs, feeRatePerKB,
+		a.Store.Credits(), minConf, bs.Height, txauthor.LargestFirst, a.changeSource)
+	if err != nil {
+		return nil, err
+	}
+
+	inputPrevTxs := make([]*btcwire.MsgTx, len(authored.SelectedUtxos))
+	for i, c := range authored.SelectedUtxos {
+		inputPrevTxs[i] = c.PrevTx
+	}
+
+	packet := psbt.NewPacket(authored.Tx, inputPrevTxs)
+	return packet.Encode()
+}
+
+// SignPSBT signs every input of a BIP-174 PSBT packet, returning the
+// packet with its final signature scripts filled in and its unsigned
+// transaction left without signature scripts.  It returns an error if
+// this account lacks the key for any input.
+func (a *Account) SignPSBT(packedTx []byte) ([]byte, error) {
+	packet, err := psbt.Decode(packedTx)
+	if err != nil {
+		return nil, err
+	}
+
+	prevOutScripts := make([][]byte, len(packet.UnsignedTx.TxIn))
+	for i, prevTx := range packet.InputPrevTxs {
+		if prevTx == nil {
+			return nil, errors.New("psbt: missing previous transaction for input")
+		}
+		outIdx := packet.UnsignedTx.TxIn[i].PreviousOutPoint.Index
+		prevOutScripts[i] = prevTx.TxOut[outIdx].PkScript
+	}
+
+	if err := txsigner.SignAll(packet.UnsignedTx, prevOutScripts, a.keyDB()); err != nil {
+		return nil, err
+	}
+	for i, txIn := range packet.UnsignedTx.TxIn {
+		packet.InputSigScripts[i] = txIn.SignatureScript
+		txIn.SignatureScript = nil
+	}
+
+	return packet.Encode()
+}
+
+// keyDB adapts an Account's wallet key lookup to the btcscript.KeyDB
+// interface SignAll and SignCredits require.  Only keys held by the
+// embedded *wallet.Wallet are found; keys of addresses derived from the
+// hd chains are not looked up.
+func (a *Account) keyDB() btcscript.KeyDB {
+	return btcscript.KeyClosure(func(addr btcutil.Address) (*btcec.PrivateKey, bool, error) {
+		key, err := a.AddressKey(addr)
+		if err != nil {
+			return nil, false, err
+		}
+		info, err := a.AddressInfo(addr)
+		if err != nil {
+			return nil, false, err
+		}
+		return key, info.Compressed, nil
+	})
+}
+
 // DumpPrivKeys returns the WIF-encoded private keys for all addresses with
 // private keys in a wallet.
 func (a *Account) DumpPrivKeys() ([]string, error) {
-	a.mtx.RLock()
-	defer a.mtx.RUnlock()
-
 	// Iterate over each active address, appending the private
 	// key to privkeys.
 	var privkeys []string
@@ -357,9 +431,6 @@ func (a *Account) DumpPrivKeys() ([]string, error) {
 // DumpWIFPrivateKey returns the WIF encoded private key for a
 // single wallet address.
 func (a *Account) DumpWIFPrivateKey(addr btcutil.Address) (string, error) {
-	a.mtx.RLock()
-	defer a.mtx.RUnlock()
-
 	// Get private key from wallet if it exists.
 	key, err := a.AddressKey(addr)
 	if err != nil {
@@ -394,7 +465,9 @@ func (a *Account) ImportPrivKey(wif string, rescan bool) error {
 			addr: struct{}{},
 		}
 
-		Rescan(CurrentRPCConn(), bs.Height, addrs)
+		if err := a.chainSvc.Rescan(bs.Height, addrs); err != nil {
+			log.Errorf("Unable to start rescan for imported address: %v", err)
+		}
 		a.writeDirtyToDisk()
 	}
 	return nil
@@ -414,27 +487,24 @@ func (a *Account) ImportWIFPrivateKey(wif string, bs *wallet.BlockStamp) (string
 	}
 
 	// Attempt to import private key into wallet.
-	a.mtx.Lock()
 	addr, err := a.ImportPrivateKey(privkey, compressed, bs)
 	if err != nil {
-		a.mtx.Unlock()
 		return "", err
 	}
 
 	// Immediately write dirty wallet to disk.
-	//
-	// TODO(jrick): change writeDirtyToDisk to not grab the writer lock.
-	// Don't want to let another goroutine waiting on the mutex to grab
-	// the mutex before it is written to disk.
 	a.dirty = true
-	a.mtx.Unlock()
 	if err := a.writeDirtyToDisk(); err != nil {
 		log.Errorf("cannot write dirty wallet: %v", err)
 		return "", fmt.Errorf("import failed: cannot write wallet: %v", err)
 	}
 
 	// Associate the imported address with this account.
-	MarkAddressForAccount(addr, a.Name())
+	a.mgr.MarkAddressForAccount(addr, a.Name())
+
+	if decoded, err := btcutil.DecodeAddress(addr, a.Net()); err == nil {
+		a.mgr.Notifier().NotifyAddressDiscovered(a.name, decoded)
+	}
 
 	log.Infof("Imported payment address %v", addr)
 
@@ -442,39 +512,67 @@ func (a *Account) ImportWIFPrivateKey(wif string, bs *wallet.BlockStamp) (string
 	return addr, nil
 }
 
-// Track requests btcd to send notifications of new transactions for
-// each address stored in a wallet.
+// hdWatchedAddresses returns every address this account's HD chains
+// have derived so far: indices [0, externalIndex) on the external
+// chain and [0, internalIndex) on the internal chain.  It returns nil
+// for an account with no hd chain.  This is the HD counterpart of
+// a.ActiveAddresses(), which only knows about the embedded legacy
+// wallet's own chain, so callers that match incoming transactions or
+// re-request notifications against "every address this account owns"
+// need both.
+func (a *Account) hdWatchedAddresses() []btcutil.Address {
+	if a.hd == nil {
+		return nil
+	}
+
+	addrs := make([]btcutil.Address, 0, a.externalIndex+a.internalIndex)
+	for i := uint32(0); i < a.externalIndex; i++ {
+		addr, err := a.hd.ExternalAddress(i, a.Net())
+		if err != nil {
+			log.Errorf("Unable to derive external address %d for account '%v': %v", i, a.name, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	for i := uint32(0); i < a.internalIndex; i++ {
+		addr, err := a.hd.InternalAddress(i, a.Net())
+		if err != nil {
+			log.Errorf("Unable to derive internal address %d for account '%v': %v", i, a.name, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Track requests the account's chain backend to send notifications of
+// new transactions for each address stored in a wallet.
 func (a *Account) Track() {
 	// Request notifications for transactions sending to all wallet
 	// addresses.
-	addrs := a.ActiveAddresses()
-	addrstrs := make([]string, len(addrs))
-	i := 0
-	for addr := range addrs {
-		addrstrs[i] = addr.EncodeAddress()
-		i++
+	infos := a.ActiveAddresses()
+	addrs := make([]btcutil.Address, 0, len(infos))
+	for addr := range infos {
+		addrs = append(addrs, addr)
 	}
+	addrs = append(addrs, a.hdWatchedAddresses()...)
 
-	err := NotifyNewTXs(CurrentRPCConn(), addrstrs)
-	if err != nil {
+	if err := a.chainSvc.NotifyReceived(addrs); err != nil {
 		log.Error("Unable to request transaction updates for address.")
 	}
 
-	a.UtxoStore.RLock()
-	for _, utxo := range a.UtxoStore.s {
-		ReqSpentUtxoNtfn(utxo)
+	for _, credit := range a.Store.Credits() {
+		a.ReqSpentUtxoNtfn(credit)
 	}
-	a.UtxoStore.RUnlock()
 }
 
-// RescanActiveAddresses requests btcd to rescan the blockchain for new
-// transactions to all active wallet addresses.  This is needed for
-// catching btcwallet up to a long-running btcd process, as otherwise
-// it would have missed notifications as blocks are attached to the
-// main chain.
+// RescanActiveAddresses asks the account's chain backend to rescan the
+// blockchain for new transactions to all active wallet addresses.
+// This is needed for catching btcwallet up to a chain backend that has
+// been running longer than the wallet, as otherwise it would have
+// missed notifications as blocks are attached to the main chain.
 func (a *Account) RescanActiveAddresses() {
 	// Determine the block to begin the rescan from.
-	a.mtx.RLock()
 	beginBlock := int32(0)
 	if a.fullRescan {
 		// Need to perform a complete rescan since the wallet creation
@@ -494,18 +592,107 @@ func (a *Account) RescanActiveAddresses() {
 		beginBlock = bs.Height + 1
 	}
 
+	if a.hd != nil {
+		a.rescanHDChain(beginBlock, false)
+		a.rescanHDChain(beginBlock, true)
+		a.writeDirtyToDisk()
+		return
+	}
+
 	// Rescan active addresses starting at the determined block height.
-	Rescan(CurrentRPCConn(), beginBlock, a.ActivePaymentAddresses())
-	a.mtx.RUnlock()
+	if err := a.chainSvc.Rescan(beginBlock, a.ActivePaymentAddresses()); err != nil {
+		log.Errorf("Unable to start rescan for account '%v': %v", a.name, err)
+	}
 	a.writeDirtyToDisk()
 }
 
+// gapLimit is the number of consecutive unused addresses rescanHDChain
+// requires before it stops deriving further addresses on a chain.
+// This is what lets a wallet restored from a BIP39 mnemonic discover
+// every address it used without walking the chain indefinitely.
+const gapLimit = 20
+
+// rescanHDChain performs gap-limit discovery on one of an HD account's
+// two chains, in batches of gapLimit addresses starting at index 0.
+// chainSvc.Rescan is asynchronous: it only queues the scan and returns
+// before any RelevantTx notifications for it have arrived, so each
+// batch's addresses are derived up front and awaitRescanFinished is
+// used to block until the whole batch has actually been scanned
+// before any address is checked for use.  Like awaitRescanFinished,
+// this runs on the caller of RescanActiveAddresses, not the
+// AccountManager goroutine, so recording which addresses in the batch
+// were used, marking them, and advancing the chain's next-address
+// index is dispatched through a.mgr.ScanHDGapBatch rather than done
+// directly here, the same reason awaitRescanFinished dispatches
+// through a.mgr.HandleRelevantTx instead of calling
+// Account.HandleRelevantTx. Once a whole batch comes back with no used
+// addresses, the gap limit has been satisfied and scanning stops.
+func (a *Account) rescanHDChain(beginBlock int32, internalChain bool) {
+	for batchStart := uint32(0); ; batchStart += gapLimit {
+		batch := make([]btcutil.Address, gapLimit)
+		addrs := make(map[string]struct{}, gapLimit)
+		for i := range batch {
+			index := batchStart + uint32(i)
+			var addr btcutil.Address
+			var err error
+			if internalChain {
+				addr, err = a.hd.InternalAddress(index, a.Net())
+			} else {
+				addr, err = a.hd.ExternalAddress(index, a.Net())
+			}
+			if err != nil {
+				log.Errorf("Unable to derive address %d for account '%v': %v", index, a.name, err)
+				return
+			}
+			batch[i] = addr
+			addrs[addr.EncodeAddress()] = struct{}{}
+		}
+
+		if err := a.chainSvc.Rescan(beginBlock, addrs); err != nil {
+			log.Errorf("Unable to rescan addresses for account '%v': %v", a.name, err)
+			return
+		}
+		a.awaitRescanFinished(batch)
+
+		done, err := a.mgr.ScanHDGapBatch(a.name, internalChain, batchStart, batch)
+		if err != nil {
+			log.Errorf("Unable to record gap-limit scan results for account '%v': %v", a.name, err)
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// awaitRescanFinished drains a.chainSvc's notification channel for the
+// duration of a single in-flight Rescan call, recording any RelevantTx
+// touching one of batch's addresses before returning once the
+// backend's RescanFinished notification arrives.  It must only be
+// called while nothing else is draining the same backend's
+// Notifications channel, which holds during the startup rescan this
+// is used for, before an account's regular notification processing
+// (see Track) has begun.  Every RelevantTx is dispatched through
+// a.mgr rather than handled directly, since this runs on the chain
+// backend's notification-draining goroutine while the AccountManager's
+// single goroutine may concurrently be reading the same Account's
+// Store.
+func (a *Account) awaitRescanFinished(batch []btcutil.Address) {
+	for {
+		switch n := (<-a.chainSvc.Notifications()).(type) {
+		case chain.RelevantTx:
+			if err := a.mgr.HandleRelevantTx(a.name, n); err != nil {
+				log.Errorf("Unable to process relevant transaction for account '%v': %v", a.name, err)
+			}
+		case chain.RescanFinished:
+			return
+		}
+	}
+}
+
 // SortedActivePaymentAddresses returns a slice of all active payment
 // addresses in an account.
 func (a *Account) SortedActivePaymentAddresses() []string {
-	a.mtx.RLock()
-	defer a.mtx.RUnlock()
-
 	infos := a.SortedActiveAddresses()
 	addrs := make([]string, len(infos))
 
@@ -519,9 +706,6 @@ func (a *Account) SortedActivePaymentAddresses() []string {
 // ActivePaymentAddresses returns a set of all active pubkey hashes
 // in an account.
 func (a *Account) ActivePaymentAddresses() map[string]struct{} {
-	a.mtx.RLock()
-	defer a.mtx.RUnlock()
-
 	infos := a.ActiveAddresses()
 	addrs := make(map[string]struct{}, len(infos))
 
@@ -532,42 +716,89 @@ func (a *Account) ActivePaymentAddresses() map[string]struct{} {
 	return addrs
 }
 
-// NewAddress returns a new payment address for an account.
+// NewAddress returns a new payment address for an account.  For an HD
+// account, this derives the next address on the external chain; for
+// an account wrapping a legacy Armory wallet, it is the next chained
+// address from the embedded wallet.
 func (a *Account) NewAddress() (btcutil.Address, error) {
-	a.mtx.Lock()
+	if a.hd != nil {
+		addr, err := a.hd.ExternalAddress(a.externalIndex, a.Net())
+		if err != nil {
+			return nil, err
+		}
+		a.externalIndex++
+		return a.publishNewAddress(addr)
+	}
 
 	// Get current block's height and hash.
 	bs, err := GetCurBlock()
 	if err != nil {
-		a.mtx.Unlock()
 		return nil, err
 	}
 
 	// Get next address from wallet.
 	addr, err := a.NextChainedAddress(&bs)
 	if err != nil {
-		a.mtx.Unlock()
 		return nil, err
 	}
 
 	// Immediately write updated wallet to disk.
 	a.dirty = true
-	a.mtx.Unlock()
 	if err = a.writeDirtyToDisk(); err != nil {
 		log.Errorf("cannot sync dirty wallet: %v", err)
 	}
 
+	return a.publishNewAddress(addr)
+}
+
+// NewChangeAddress returns a new change address derived from an HD
+// account's internal chain.  Accounts wrapping a legacy Armory wallet
+// have no separate change chain and must use NewAddress for change
+// outputs instead, matching their previous behavior.
+func (a *Account) NewChangeAddress() (btcutil.Address, error) {
+	if a.hd == nil {
+		return nil, errors.New("account has no internal (change) chain")
+	}
+
+	addr, err := a.hd.InternalAddress(a.internalIndex, a.Net())
+	if err != nil {
+		return nil, err
+	}
+	a.internalIndex++
+
+	return a.publishNewAddress(addr)
+}
+
+// Seed returns the BIP39 mnemonic phrase backing this account's HD
+// chains, for backup or export.  It returns an error for an account
+// with no hd chain, i.e. one wrapping a legacy Armory wallet (see
+// AccountManager.WrapLegacyAccount).
+func (a *Account) Seed() (string, error) {
+	if a.hd == nil {
+		return "", errors.New("account has no HD seed")
+	}
+	return a.hd.Seed()
+}
+
+// publishNewAddress marks addr as belonging to this account, requests
+// chain notifications for it, and publishes an AddressDiscovered
+// notification.
+func (a *Account) publishNewAddress(addr btcutil.Address) (btcutil.Address, error) {
 	// Mark this new address as belonging to this account.
-	MarkAddressForAccount(addr.EncodeAddress(), a.Name())
+	a.mgr.MarkAddressForAccount(addr.EncodeAddress(), a.Name())
 
-	// Request updates from btcd for new transactions sent to this address.
+	// Request updates from the chain backend for new transactions sent
+	// to this address.
 	a.ReqNewTxsForAddress(addr)
 
+	a.mgr.Notifier().NotifyAddressDiscovered(a.name, addr)
+
 	return addr, nil
 }
 
-// ReqNewTxsForAddress sends a message to btcd to request tx updates
-// for addr for each new block that is added to the blockchain.
+// ReqNewTxsForAddress asks the account's chain backend to request tx
+// updates for addr for each new block that is added to the
+// blockchain.
 func (a *Account) ReqNewTxsForAddress(addr btcutil.Address) {
 	// Only support P2PKH addresses currently.
 	apkh, ok := addr.(*btcutil.AddressPubKeyHash)
@@ -577,19 +808,94 @@ func (a *Account) ReqNewTxsForAddress(addr btcutil.Address) {
 
 	log.Debugf("Requesting notifications of TXs sending to address %v", apkh)
 
-	err := NotifyNewTXs(CurrentRPCConn(), []string{apkh.EncodeAddress()})
-	if err != nil {
+	if err := a.chainSvc.NotifyReceived([]btcutil.Address{apkh}); err != nil {
 		log.Error("Unable to request transaction updates for address.")
 	}
 }
 
-// ReqSpentUtxoNtfn sends a message to btcd to request updates for when
-// a stored UTXO has been spent.
-func ReqSpentUtxoNtfn(u *tx.Utxo) {
+// ReqSpentUtxoNtfn asks the account's chain backend to request updates
+// for when a stored credit has been spent.
+func (a *Account) ReqSpentUtxoNtfn(c *wtxmgr.Credit) {
 	log.Debugf("Requesting spent UTXO notifications for Outpoint hash %s index %d",
-		u.Out.Hash, u.Out.Index)
+		c.Out.Hash, c.Out.Index)
 
-	NotifySpent(CurrentRPCConn(), (*btcwire.OutPoint)(&u.Out))
+	a.chainSvc.NotifySpent(&c.Out)
+}
+
+// HandleRelevantTx processes a chain.RelevantTx notification: any
+// output paying to one of this account's addresses is recorded as a
+// new credit and indexed by address, any input spending one of this
+// account's existing credits is marked spent, and
+// TransactionAccepted, TransactionConfirmed, and AccountBalance
+// notifications are published through the AccountManager's
+// NotificationServer.  This is the tx-arrival counterpart to Rollback,
+// which undoes credits recorded and spends marked here when their
+// block is later disconnected.
+func (a *Account) HandleRelevantTx(rtx chain.RelevantTx) error {
+	msgTx := rtx.Tx.MsgTx()
+	txHash := *rtx.Tx.Sha()
+
+	// Match against every address this account owns: the legacy
+	// wallet's own chain, plus every address derived so far on an HD
+	// account's external and internal chains.
+	infos := a.ActiveAddresses()
+	watched := make([]btcutil.Address, 0, len(infos))
+	for addr := range infos {
+		watched = append(watched, addr)
+	}
+	watched = append(watched, a.hdWatchedAddresses()...)
+
+	accepted := false
+	for i, txOut := range msgTx.TxOut {
+		for _, addr := range watched {
+			script, err := btcscript.PayToAddrScript(addr)
+			if err != nil || !bytes.Equal(script, txOut.PkScript) {
+				continue
+			}
+
+			var addrHash [btcwire.HashSize]byte
+			copy(addrHash[:], addr.ScriptAddress())
+			out := btcwire.OutPoint{Hash: txHash, Index: uint32(i)}
+			a.Store.InsertCredit(&wtxmgr.Credit{
+				Out:      out,
+				AddrHash: addrHash,
+				PkScript: txOut.PkScript,
+				Amount:   uint64(txOut.Value),
+				Height:   rtx.Height,
+				PrevTx:   msgTx,
+			})
+			a.Store.InsertRecv(rtx.Height, &tx.RecvTx{
+				TxID:         txHash,
+				Height:       rtx.Height,
+				ReceiverHash: addr.ScriptAddress(),
+			})
+			a.ReqSpentUtxoNtfn(&wtxmgr.Credit{Out: out})
+			accepted = true
+		}
+	}
+
+	spent := false
+	for i, txIn := range msgTx.TxIn {
+		spender := btcwire.OutPoint{Hash: txHash, Index: uint32(i)}
+		if a.Store.SpendCredit(txIn.PreviousOutPoint, spender, rtx.Height) {
+			a.mgr.Notifier().NotifySpentness(txIn.PreviousOutPoint, true)
+			spent = true
+		}
+	}
+
+	if !accepted && !spent {
+		return nil
+	}
+	a.storeDirty = true
+
+	notifier := a.mgr.Notifier()
+	notifier.NotifyTransactionAccepted(a.name, txHash)
+	if rtx.Height != -1 {
+		notifier.NotifyTransactionConfirmed(a.name, txHash, rtx.Height)
+	}
+	notifier.NotifyAccountBalance(a.name, a.CalculateBalance(0), rtx.Height != -1)
+
+	return nil
 }
 
 // accountdir returns the directory containing an account's wallet, utxo,
@@ -0,0 +1,513 @@
+/*
+ * Copyright (c) 2013, 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwallet/chain"
+	"github.com/conformal/btcwallet/wallet"
+	"github.com/conformal/btcwallet/wallet/hdaccount"
+	"github.com/conformal/btcwallet/wtxmgr"
+	"github.com/conformal/btcwire"
+)
+
+// Bounded request queue depth.  RPC calls made while the queue is full
+// are failed immediately rather than left to pile up behind a slow or
+// stuck account.
+const requestQueueDepth = 100
+
+// ErrAcctMgrBusy is returned by AccountManager methods when the request
+// queue is full.  Callers (RPC handlers) should surface this as a
+// temporary failure rather than blocking the client.
+var ErrAcctMgrBusy = errors.New("account manager request queue is full")
+
+// AccountManager is the sole owner of all in-memory Account state.  A
+// single goroutine (run by Start) reads from requests and mutates
+// accounts, addrAccount, and every registered Account's Store and
+// wallet fields directly, so no Account, UtxoStore, or TxStore locking
+// is required by callers: every read or write, including
+// RelevantTxRequest and RollbackRequest from a chain backend's
+// notification-draining goroutine, is funneled through a
+// request/response round trip on a channel instead. Nothing may touch
+// an Account's fields outside of this goroutine.
+//
+// notifier is the typed, per-subscriber counterpart to the request
+// queue: account.go publishes AccountBalance, TransactionAccepted,
+// TransactionConfirmed, AddressDiscovered, and Spentness events through
+// it instead of calling a wire-protocol-specific helper directly, so
+// both the JSON-RPC layer and any future gRPC layer can each Subscribe
+// and receive only what they asked for.
+type AccountManager struct {
+	accounts    map[string]*Account
+	addrAccount map[string]string
+
+	requests chan interface{}
+	notifier *wallet.NotificationServer
+}
+
+// NewAccountManager creates a new AccountManager with no accounts.
+// Start must be called before any request methods are used.
+func NewAccountManager() *AccountManager {
+	return &AccountManager{
+		accounts:    make(map[string]*Account),
+		addrAccount: make(map[string]string),
+		requests:    make(chan interface{}, requestQueueDepth),
+		notifier:    wallet.NewNotificationServer(),
+	}
+}
+
+// Notifier returns the manager's NotificationServer.  RPC servers
+// subscribe to it to receive account events instead of being called
+// into directly.
+func (am *AccountManager) Notifier() *wallet.NotificationServer {
+	return am.notifier
+}
+
+// Start begins the manager's request-processing goroutine and returns
+// immediately.  The goroutine runs until requests is closed.
+func (am *AccountManager) Start() {
+	go am.accountHandler()
+}
+
+// accountHandler serializes all access to account state by running in
+// a single goroutine and handling one request at a time.  This is the
+// only goroutine that may read or write am.accounts or
+// am.addrAccount, and the only goroutine that may touch the fields of
+// any *Account reachable from them.
+func (am *AccountManager) accountHandler() {
+	for req := range am.requests {
+		switch r := req.(type) {
+		case GetBalanceRequest:
+			r.Response <- am.execGetBalance(r)
+
+		case ListTxRequest:
+			r.Response <- am.execListTx(r)
+
+		case NewAddressRequest:
+			r.Response <- am.execNewAddress(r)
+
+		case RelevantTxRequest:
+			r.Response <- am.execRelevantTx(r)
+
+		case RollbackRequest:
+			am.execRollback(r)
+			close(r.Response)
+
+		case HDGapScanRequest:
+			r.Response <- am.execHDGapScan(r)
+		}
+	}
+}
+
+// AddAccount registers an account with the manager.  It must be
+// called before the account's name can be used in any request.
+func (am *AccountManager) AddAccount(a *Account) {
+	a.mgr = am
+	am.accounts[a.name] = a
+}
+
+// importedAccountName is the name WrapLegacyAccount registers a
+// migrated legacy Armory wallet under.
+const importedAccountName = "imported"
+
+// WrapLegacyAccount registers a pre-existing Account backed by a
+// legacy, pre-HD Armory wallet (one with no hd chain) as the
+// "imported" account, so a wallet upgraded to the HD account
+// hierarchy keeps access to its old keys and transaction history.
+// This is a one-way, one-time migration, mirroring
+// wtxmgr.MigrateLegacy: legacy keeps deriving every address, including
+// change, from its embedded *wallet.Wallet chain instead of a BIP44
+// chain (see Account.NewChangeAddress), and is never converted to an
+// hd account.
+func (am *AccountManager) WrapLegacyAccount(legacy *Account) {
+	legacy.name = importedAccountName
+	am.AddAccount(legacy)
+}
+
+// mnemonicEntropyBits is the BIP39 entropy size NewHDAccount generates
+// a fresh mnemonic with: 128 bits yields the usual 12-word phrase.
+const mnemonicEntropyBits = 128
+
+// NewHDAccount creates and registers a new account named name backed
+// by an HD (BIP44) key chain derived from a freshly generated BIP39
+// mnemonic, under BIP44 coin type coinType, instead of a legacy Armory
+// wallet (see WrapLegacyAccount). walletKeystore provides the
+// encrypted key storage, lock state, and network parameters every
+// Account needs regardless of how it derives addresses; the caller is
+// responsible for constructing it. HD addresses are derived from the hd
+// chain and do not require it to be unlocked. The generated mnemonic is returned so the caller can
+// display it to the user for backup: NewHDAccount does not retain it
+// anywhere else, and it cannot be recovered later except through
+// Account.Seed.
+func (am *AccountManager) NewHDAccount(name string, coinType uint32, walletKeystore *wallet.Wallet, chainSvc chain.Interface) (*Account, string, error) {
+	mnemonic, err := hdaccount.NewMnemonic(mnemonicEntropyBits)
+	if err != nil {
+		return nil, "", err
+	}
+	hd, err := hdaccount.LoadFromMnemonic(mnemonic, "", coinType, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	a := &Account{
+		Wallet: walletKeystore,
+		name:   name,
+		hd:     hd,
+		Store:  wtxmgr.NewStore(),
+	}
+	a.SetChainSvc(chainSvc)
+	am.AddAccount(a)
+
+	return a, mnemonic, nil
+}
+
+// RestoreHDAccount creates and registers a new account named name
+// backed by an HD (BIP44) key chain derived from a previously
+// exported BIP39 mnemonic phrase and passphrase, the restore-from-
+// backup counterpart to NewHDAccount's freshly generated mnemonic.
+// Unlike NewHDAccount, it performs a full gap-limit rescan of both
+// chains before returning, to discover every address the restored
+// account used, the same scan RescanActiveAddresses runs for any HD
+// account (see rescanHDChain) — the caller must not itself be
+// draining chainSvc's notifications concurrently, for the same reason
+// documented on Account.awaitRescanFinished.
+func (am *AccountManager) RestoreHDAccount(name, mnemonic, passphrase string, coinType uint32, walletKeystore *wallet.Wallet, chainSvc chain.Interface) (*Account, error) {
+	hd, err := hdaccount.LoadFromMnemonic(mnemonic, passphrase, coinType, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Account{
+		Wallet:     walletKeystore,
+		name:       name,
+		hd:         hd,
+		fullRescan: true,
+		Store:      wtxmgr.NewStore(),
+	}
+	a.SetChainSvc(chainSvc)
+	am.AddAccount(a)
+
+	a.RescanActiveAddresses()
+
+	return a, nil
+}
+
+// Account returns the account with the given name, or ErrNotFound if
+// no account with that name has been registered.
+func (am *AccountManager) Account(name string) (*Account, error) {
+	a, ok := am.accounts[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return a, nil
+}
+
+// MarkAddressForAccount marks an address as belonging to an account.
+// This replaces the old package-level addressAccountMap: each
+// AccountManager now owns its own mapping instead of sharing a single
+// package global.
+func (am *AccountManager) MarkAddressForAccount(address, account string) {
+	am.addrAccount[address] = account
+}
+
+// LookupAccountByAddress returns the account name for address.  error
+// will be set to ErrNotFound if the address has not been marked as
+// associated with any account.
+func (am *AccountManager) LookupAccountByAddress(address string) (string, error) {
+	account, ok := am.addrAccount[address]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return account, nil
+}
+
+// GetBalanceRequest requests the confirmed balance of account Account,
+// using Confirms as the minimum number of confirmations an unspent
+// output must have to be included in the sum.
+type GetBalanceRequest struct {
+	Account  string
+	Confirms int
+	Response chan GetBalanceResponse
+}
+
+// GetBalanceResponse is the result of a GetBalanceRequest.
+type GetBalanceResponse struct {
+	Balance float64
+	Err     error
+}
+
+// GetBalance dispatches a GetBalanceRequest to the manager and blocks
+// for the response.  It returns ErrAcctMgrBusy without blocking if the
+// request queue is full.
+func (am *AccountManager) GetBalance(account string, confirms int) (float64, error) {
+	req := GetBalanceRequest{
+		Account:  account,
+		Confirms: confirms,
+		Response: make(chan GetBalanceResponse, 1),
+	}
+	select {
+	case am.requests <- req:
+	default:
+		return 0, ErrAcctMgrBusy
+	}
+	resp := <-req.Response
+	return resp.Balance, resp.Err
+}
+
+func (am *AccountManager) execGetBalance(r GetBalanceRequest) GetBalanceResponse {
+	a, err := am.Account(r.Account)
+	if err != nil {
+		return GetBalanceResponse{Err: err}
+	}
+	return GetBalanceResponse{Balance: a.CalculateBalance(r.Confirms)}
+}
+
+// ListTxRequest requests a page of an account's transaction history,
+// using the same from/count semantics as Account.ListTransactions.
+type ListTxRequest struct {
+	Account  string
+	From     int
+	Count    int
+	Response chan ListTxResponse
+}
+
+// ListTxResponse is the result of a ListTxRequest.
+type ListTxResponse struct {
+	Txs []map[string]interface{}
+	Err error
+}
+
+// ListTransactions dispatches a ListTxRequest to the manager and
+// blocks for the response.  It returns ErrAcctMgrBusy without blocking
+// if the request queue is full.
+func (am *AccountManager) ListTransactions(account string, from, count int) ([]map[string]interface{}, error) {
+	req := ListTxRequest{
+		Account:  account,
+		From:     from,
+		Count:    count,
+		Response: make(chan ListTxResponse, 1),
+	}
+	select {
+	case am.requests <- req:
+	default:
+		return nil, ErrAcctMgrBusy
+	}
+	resp := <-req.Response
+	return resp.Txs, resp.Err
+}
+
+func (am *AccountManager) execListTx(r ListTxRequest) ListTxResponse {
+	a, err := am.Account(r.Account)
+	if err != nil {
+		return ListTxResponse{Err: err}
+	}
+	txs, err := a.ListTransactions(r.From, r.Count)
+	return ListTxResponse{Txs: txs, Err: err}
+}
+
+// NewAddressRequest requests that a new payment address be generated
+// for an account.
+type NewAddressRequest struct {
+	Account  string
+	Response chan NewAddressResponse
+}
+
+// NewAddressResponse is the result of a NewAddressRequest.
+type NewAddressResponse struct {
+	Addr btcutil.Address
+	Err  error
+}
+
+// NewAddress dispatches a NewAddressRequest to the manager and blocks
+// for the response.  It returns ErrAcctMgrBusy without blocking if the
+// request queue is full.
+func (am *AccountManager) NewAddress(account string) (btcutil.Address, error) {
+	req := NewAddressRequest{
+		Account:  account,
+		Response: make(chan NewAddressResponse, 1),
+	}
+	select {
+	case am.requests <- req:
+	default:
+		return nil, ErrAcctMgrBusy
+	}
+	resp := <-req.Response
+	return resp.Addr, resp.Err
+}
+
+func (am *AccountManager) execNewAddress(r NewAddressRequest) NewAddressResponse {
+	a, err := am.Account(r.Account)
+	if err != nil {
+		return NewAddressResponse{Err: err}
+	}
+	addr, err := a.NewAddress()
+	return NewAddressResponse{Addr: addr, Err: err}
+}
+
+// RelevantTxRequest asks the manager to record a chain.RelevantTx
+// notification against account.  A chain backend's
+// notification-draining goroutine must dispatch through this request
+// rather than calling Account.HandleRelevantTx directly, since that
+// mutates the account's Store concurrently with the manager goroutine
+// otherwise.
+type RelevantTxRequest struct {
+	Account  string
+	Tx       chain.RelevantTx
+	Response chan RelevantTxResponse
+}
+
+// RelevantTxResponse is the result of a RelevantTxRequest.
+type RelevantTxResponse struct {
+	Err error
+}
+
+// HandleRelevantTx dispatches a RelevantTxRequest to the manager and
+// blocks for the response.  It returns ErrAcctMgrBusy without blocking
+// if the request queue is full.
+func (am *AccountManager) HandleRelevantTx(account string, rtx chain.RelevantTx) error {
+	req := RelevantTxRequest{
+		Account:  account,
+		Tx:       rtx,
+		Response: make(chan RelevantTxResponse, 1),
+	}
+	select {
+	case am.requests <- req:
+	default:
+		return ErrAcctMgrBusy
+	}
+	resp := <-req.Response
+	return resp.Err
+}
+
+func (am *AccountManager) execRelevantTx(r RelevantTxRequest) RelevantTxResponse {
+	a, err := am.Account(r.Account)
+	if err != nil {
+		return RelevantTxResponse{Err: err}
+	}
+	return RelevantTxResponse{Err: a.HandleRelevantTx(r.Tx)}
+}
+
+// RollbackRequest asks the manager to revert account to a state before
+// the block at height and hash was connected to the main chain.  Like
+// RelevantTxRequest, a chain backend's notification-draining goroutine
+// must dispatch through this request rather than calling
+// Account.Rollback directly.
+type RollbackRequest struct {
+	Account  string
+	Height   int32
+	Hash     *btcwire.ShaHash
+	Response chan struct{}
+}
+
+// Rollback dispatches a RollbackRequest to the manager and blocks until
+// it has been applied.  It returns ErrAcctMgrBusy without blocking if
+// the request queue is full.
+func (am *AccountManager) Rollback(account string, height int32, hash *btcwire.ShaHash) error {
+	req := RollbackRequest{
+		Account:  account,
+		Height:   height,
+		Hash:     hash,
+		Response: make(chan struct{}),
+	}
+	select {
+	case am.requests <- req:
+	default:
+		return ErrAcctMgrBusy
+	}
+	<-req.Response
+	return nil
+}
+
+func (am *AccountManager) execRollback(r RollbackRequest) {
+	a, err := am.Account(r.Account)
+	if err != nil {
+		return
+	}
+	a.Rollback(r.Height, r.Hash)
+}
+
+// HDGapScanRequest asks the manager to record the result of one
+// rescanHDChain batch: every address in Batch that AddressUsed reports
+// as used is marked as belonging to Account, and the chain's
+// next-address index is advanced past the last used address. Like
+// RelevantTxRequest and RollbackRequest, a chain backend's
+// notification-draining goroutine (where rescanHDChain's caller runs)
+// must dispatch through this request rather than touching the
+// account's index fields or addrAccount directly.
+type HDGapScanRequest struct {
+	Account       string
+	InternalChain bool
+	BatchStart    uint32
+	Batch         []btcutil.Address
+	Response      chan HDGapScanResponse
+}
+
+// HDGapScanResponse is the result of an HDGapScanRequest. Done reports
+// whether the batch came back with no used addresses, satisfying the
+// gap limit and ending the scan of this chain.
+type HDGapScanResponse struct {
+	Done bool
+	Err  error
+}
+
+// ScanHDGapBatch dispatches an HDGapScanRequest to the manager and
+// blocks for the response. It returns ErrAcctMgrBusy without blocking
+// if the request queue is full.
+func (am *AccountManager) ScanHDGapBatch(account string, internalChain bool, batchStart uint32, batch []btcutil.Address) (bool, error) {
+	req := HDGapScanRequest{
+		Account:       account,
+		InternalChain: internalChain,
+		BatchStart:    batchStart,
+		Batch:         batch,
+		Response:      make(chan HDGapScanResponse, 1),
+	}
+	select {
+	case am.requests <- req:
+	default:
+		return false, ErrAcctMgrBusy
+	}
+	resp := <-req.Response
+	return resp.Done, resp.Err
+}
+
+func (am *AccountManager) execHDGapScan(r HDGapScanRequest) HDGapScanResponse {
+	a, err := am.Account(r.Account)
+	if err != nil {
+		return HDGapScanResponse{Err: err}
+	}
+
+	lastUsed := -1
+	for i, addr := range r.Batch {
+		if a.AddressUsed(addr) {
+			lastUsed = i
+			am.MarkAddressForAccount(addr.EncodeAddress(), a.name)
+		}
+	}
+	if lastUsed == -1 {
+		return HDGapScanResponse{Done: true}
+	}
+
+	nextIndex := r.BatchStart + uint32(lastUsed) + 1
+	if r.InternalChain {
+		a.internalIndex = nextIndex
+	} else {
+		a.externalIndex = nextIndex
+	}
+	return HDGapScanResponse{}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package chain
+
+import (
+	"github.com/conformal/btcrpcclient"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// BtcdClient implements Interface backed by a trusted btcd node's
+// websocket RPC connection, using the "notifynewtxs", "notifyspent",
+// and "rescan" extensions btcd exposes beyond the standard JSON-RPC
+// API.  This is the original, and still default, chain backend.
+type BtcdClient struct {
+	client        *btcrpcclient.Client
+	params        *btcwire.Params
+	notifications chan interface{}
+}
+
+// NewBtcdClient creates a BtcdClient that will connect to a btcd
+// instance using connCfg, decoding rescan addresses against params.
+// The returned client is not yet connected; call Connect to dial the
+// server and begin receiving notifications.
+func NewBtcdClient(connCfg *btcrpcclient.ConnConfig, params *btcwire.Params) (*BtcdClient, error) {
+	c := &BtcdClient{
+		params:        params,
+		notifications: make(chan interface{}, 20),
+	}
+
+	ntfnHandlers := btcrpcclient.NotificationHandlers{
+		OnBlockConnected: func(hash *btcwire.ShaHash, height int32) {
+			c.notifications <- BlockConnected{Height: height, Hash: hash}
+		},
+		OnBlockDisconnected: func(hash *btcwire.ShaHash, height int32) {
+			c.notifications <- BlockDisconnected{Height: height, Hash: hash}
+		},
+		OnRecvTx: func(tx *btcutil.Tx, block *btcrpcclient.BlockDetails) {
+			height := int32(-1)
+			if block != nil {
+				height = block.Height
+			}
+			c.notifications <- RelevantTx{Tx: tx, Height: height}
+		},
+		OnRedeemingTx: func(tx *btcutil.Tx, block *btcrpcclient.BlockDetails) {
+			height := int32(-1)
+			if block != nil {
+				height = block.Height
+			}
+			c.notifications <- RelevantTx{Tx: tx, Height: height}
+		},
+		OnRescanFinished: func(hash *btcwire.ShaHash, height int32, blkTime int64) {
+			c.notifications <- RescanFinished{Hash: hash, Height: height}
+		},
+	}
+
+	client, err := btcrpcclient.New(connCfg, &ntfnHandlers)
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+	return c, nil
+}
+
+// Connect implements the Interface.
+func (c *BtcdClient) Connect() error {
+	return c.client.NotifyBlocks()
+}
+
+// Notifications implements the Interface.
+func (c *BtcdClient) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// NotifyReceived implements the Interface.
+func (c *BtcdClient) NotifyReceived(addrs []btcutil.Address) error {
+	return c.client.NotifyReceived(addrs)
+}
+
+// NotifySpent implements the Interface.
+func (c *BtcdClient) NotifySpent(outpoint *btcwire.OutPoint) error {
+	return c.client.NotifySpent([]*btcwire.OutPoint{outpoint})
+}
+
+// Rescan implements the Interface.
+func (c *BtcdClient) Rescan(startHeight int32, addrs map[string]struct{}) error {
+	addresses := make([]btcutil.Address, 0, len(addrs))
+	for encoded := range addrs {
+		addr, err := btcutil.DecodeAddress(encoded, c.params)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, addr)
+	}
+	return c.client.Rescan(startHeight, addresses, nil)
+}
+
+// GetBlock implements the Interface.
+func (c *BtcdClient) GetBlock(hash *btcwire.ShaHash) (*btcwire.MsgBlock, error) {
+	return c.client.GetBlock(hash)
+}
+
+// Stop implements the Interface.
+func (c *BtcdClient) Stop() {
+	c.client.Shutdown()
+	close(c.notifications)
+}
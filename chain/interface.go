@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package chain defines a backend-agnostic interface for everything the
+// wallet needs from a Bitcoin chain source.  Two implementations are
+// provided: BtcdClient, which wraps a trusted btcd websocket RPC
+// connection, and NeutrinoClient, a BIP157/158 compact-block-filter
+// light client that talks directly to full nodes.  Account no longer
+// calls package-level RPC helpers or CurrentRPCConn() itself; it is
+// handed an Interface and drives it through the generic notification
+// channel returned by Notifications.
+package chain
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// Interface is implemented by each supported chain backend.  All
+// methods must be safe for concurrent use.
+type Interface interface {
+	// Connect establishes the backend's connection to the chain
+	// source (a btcd RPC server, or a set of full node peers).
+	Connect() error
+
+	// Notifications returns the channel that all chain events for
+	// this backend are delivered on.  The concrete event types sent
+	// are BlockConnected, BlockDisconnected, RelevantTx, and
+	// RescanFinished, defined below.
+	Notifications() <-chan interface{}
+
+	// NotifyReceived requests notification of any new transactions
+	// paying to any of the passed addresses.
+	NotifyReceived(addrs []btcutil.Address) error
+
+	// NotifySpent requests notification of a transaction spending
+	// outpoint.
+	NotifySpent(outpoint *btcwire.OutPoint) error
+
+	// Rescan asks the backend to replay the chain starting at
+	// startHeight, delivering RelevantTx notifications for any
+	// transaction touching addrs.
+	Rescan(startHeight int32, addrs map[string]struct{}) error
+
+	// GetBlock fetches a full block by hash.  The btcd backend asks
+	// its RPC peer directly; the Neutrino backend only ever calls
+	// this after a compact filter for the block has matched one of
+	// the wallet's addresses.
+	GetBlock(hash *btcwire.ShaHash) (*btcwire.MsgBlock, error)
+
+	// Stop shuts the backend down and closes the Notifications
+	// channel.
+	Stop()
+}
+
+// BlockConnected is sent on a backend's notification channel when a
+// new block is attached to the best chain.
+type BlockConnected struct {
+	Height int32
+	Hash   *btcwire.ShaHash
+}
+
+// BlockDisconnected is sent on a backend's notification channel when a
+// block is removed from the best chain, e.g. during a reorg.
+type BlockDisconnected struct {
+	Height int32
+	Hash   *btcwire.ShaHash
+}
+
+// RelevantTx is sent on a backend's notification channel for any
+// transaction touching a wallet address or outpoint the backend was
+// asked to watch.
+type RelevantTx struct {
+	Tx     *btcutil.Tx
+	Height int32
+}
+
+// RescanFinished is sent once a Rescan call has replayed every block
+// up to the backend's current best height.
+type RescanFinished struct {
+	Hash   *btcwire.ShaHash
+	Height int32
+}
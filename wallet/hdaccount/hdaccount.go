@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package hdaccount implements BIP32/BIP44 hierarchical key
+// derivation for wallet accounts: a single master seed, optionally
+// itself derived from a BIP39 mnemonic phrase, produces many named
+// accounts under m/44'/coinType'/account', each with its own external
+// (receiving) and internal (change) chains.  It replaces the flat,
+// single-chain Armory-style address derivation that btcwallet
+// previously used for every account.
+package hdaccount
+
+import (
+	"errors"
+
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcutil/hdkeychain"
+	"github.com/conformal/btcwire"
+)
+
+// purpose is the BIP43/BIP44 hardened purpose component of every
+// derivation path this package produces.
+const purpose = 44 + hdkeychain.HardenedKeyStart
+
+// External and internal are the BIP44 change-level constants: 0 for
+// the receiving chain, 1 for the change chain.
+const (
+	external uint32 = 0
+	internal uint32 = 1
+)
+
+// Keychain derives BIP44 accounts from a single master extended key.
+type Keychain struct {
+	master   *hdkeychain.ExtendedKey
+	coinType uint32
+
+	// mnemonic is the BIP39 phrase the master key was derived from,
+	// or empty if NewKeychain was given raw seed bytes instead.  It
+	// is carried forward onto every Account this Keychain derives so
+	// Account.Seed can return it again for backup.
+	mnemonic string
+}
+
+// NewKeychain derives a Keychain's master key from seed.  coinType is
+// the BIP44 coin type to derive accounts under (0 for Bitcoin
+// mainnet).
+func NewKeychain(seed []byte, coinType uint32) (*Keychain, error) {
+	master, err := hdkeychain.NewMaster(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &Keychain{master: master, coinType: coinType}, nil
+}
+
+// NewKeychainFromMnemonic derives a Keychain the same way as
+// NewKeychain, but from a BIP39 mnemonic phrase and passphrase instead
+// of raw seed bytes.  The mnemonic is retained so it can be recovered
+// later through any Account this Keychain derives.
+func NewKeychainFromMnemonic(mnemonic, passphrase string, coinType uint32) (*Keychain, error) {
+	if !ValidMnemonic(mnemonic) {
+		return nil, ErrInvalidMnemonic
+	}
+
+	k, err := NewKeychain(SeedFromMnemonic(mnemonic, passphrase), coinType)
+	if err != nil {
+		return nil, err
+	}
+	k.mnemonic = mnemonic
+	return k, nil
+}
+
+// LoadFromMnemonic derives the BIP44 account at index account directly
+// from a BIP39 mnemonic phrase and passphrase.  This is the usual
+// entry point for restoring a wallet from a previously exported Seed:
+// it skips the intermediate Keychain for the common case of a wallet
+// with a single active account.  The caller still needs to perform a
+// gap-limit rescan to discover any addresses the account used before
+// this wallet instance derived it.
+func LoadFromMnemonic(mnemonic, passphrase string, coinType, account uint32) (*Account, error) {
+	k, err := NewKeychainFromMnemonic(mnemonic, passphrase, coinType)
+	if err != nil {
+		return nil, err
+	}
+	return k.Account(account)
+}
+
+// Account derives the BIP44 account extended key at
+// m/44'/coinType'/account' and returns its external and internal
+// chains.
+func (k *Keychain) Account(account uint32) (*Account, error) {
+	purposeKey, err := k.master.Child(purpose)
+	if err != nil {
+		return nil, err
+	}
+	coinKey, err := purposeKey.Child(k.coinType + hdkeychain.HardenedKeyStart)
+	if err != nil {
+		return nil, err
+	}
+	acctKey, err := coinKey.Child(account + hdkeychain.HardenedKeyStart)
+	if err != nil {
+		return nil, err
+	}
+
+	externalKey, err := acctKey.Child(external)
+	if err != nil {
+		return nil, err
+	}
+	internalKey, err := acctKey.Child(internal)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Account{
+		external: externalKey,
+		internal: internalKey,
+		mnemonic: k.mnemonic,
+	}, nil
+}
+
+// Account is a single BIP44 account's external and internal chains.
+type Account struct {
+	external *hdkeychain.ExtendedKey
+	internal *hdkeychain.ExtendedKey
+	mnemonic string
+}
+
+// ErrNoMnemonic is returned by Account.Seed when its keychain was
+// constructed from raw seed bytes via NewKeychain rather than a BIP39
+// mnemonic, and so has no mnemonic to return.
+var ErrNoMnemonic = errors.New("hdaccount: account's keychain has no mnemonic")
+
+// Seed returns the BIP39 mnemonic phrase this account's keychain was
+// derived from, for backup or export.
+func (a *Account) Seed() (string, error) {
+	if a.mnemonic == "" {
+		return "", ErrNoMnemonic
+	}
+	return a.mnemonic, nil
+}
+
+// ExternalAddress derives the payment address at external chain index
+// idx.
+func (a *Account) ExternalAddress(idx uint32, net btcwire.BitcoinNet) (btcutil.Address, error) {
+	return chainAddress(a.external, idx, net)
+}
+
+// InternalAddress derives the change address at internal chain index
+// idx.
+func (a *Account) InternalAddress(idx uint32, net btcwire.BitcoinNet) (btcutil.Address, error) {
+	return chainAddress(a.internal, idx, net)
+}
+
+// ExternalKey derives the private key at external chain index idx.
+func (a *Account) ExternalKey(idx uint32) (*btcec.PrivateKey, error) {
+	return chainKey(a.external, idx)
+}
+
+// InternalKey derives the private key at internal chain index idx.
+func (a *Account) InternalKey(idx uint32) (*btcec.PrivateKey, error) {
+	return chainKey(a.internal, idx)
+}
+
+func chainAddress(chainKeyParent *hdkeychain.ExtendedKey, idx uint32, net btcwire.BitcoinNet) (btcutil.Address, error) {
+	child, err := chainKeyParent.Child(idx)
+	if err != nil {
+		return nil, err
+	}
+	return child.Address(net)
+}
+
+func chainKey(chainKeyParent *hdkeychain.ExtendedKey, idx uint32) (*btcec.PrivateKey, error) {
+	child, err := chainKeyParent.Child(idx)
+	if err != nil {
+		return nil, err
+	}
+	return child.ECPrivKey()
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package hdaccount
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"strings"
+)
+
+// seedPBKDF2Rounds and seedKeyLen are the BIP39 parameters for
+// stretching a mnemonic and passphrase into a 64-byte seed.
+const (
+	seedPBKDF2Rounds = 2048
+	seedKeyLen       = 64
+)
+
+// ErrInvalidMnemonic is returned by NewKeychainFromMnemonic (and so by
+// LoadFromMnemonic) when a mnemonic phrase is not a
+// space-separated list of words from the BIP39 English wordlist with a
+// valid length and checksum.
+var ErrInvalidMnemonic = errors.New("hdaccount: invalid mnemonic")
+
+// wordIndex maps every word in englishWordlist to its position, built
+// once at package init so ValidMnemonic doesn't linearly scan the list
+// per word.
+var wordIndex = func() map[string]uint16 {
+	m := make(map[string]uint16, len(englishWordlist))
+	for i, w := range englishWordlist {
+		m[w] = uint16(i)
+	}
+	return m
+}()
+
+// NewMnemonic generates a fresh BIP39 mnemonic phrase from
+// entropyBits of cryptographically random entropy.  entropyBits must
+// be a multiple of 32 in the range [128, 256]; 128 yields a 12-word
+// mnemonic and 256 a 24-word mnemonic.
+func NewMnemonic(entropyBits int) (string, error) {
+	if entropyBits < 128 || entropyBits > 256 || entropyBits%32 != 0 {
+		return "", errors.New("hdaccount: entropyBits must be a multiple of 32 between 128 and 256")
+	}
+
+	entropy := make([]byte, entropyBits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return entropyToMnemonic(entropy)
+}
+
+// entropyToMnemonic encodes entropy and its SHA256 checksum as a
+// space-separated BIP39 mnemonic phrase.
+func entropyToMnemonic(entropy []byte) (string, error) {
+	entropyBits := len(entropy) * 8
+	checksumBits := entropyBits / 32
+
+	checksum := sha256.Sum256(entropy)
+	bits := make([]bool, entropyBits+checksumBits)
+	for i := 0; i < entropyBits; i++ {
+		bits[i] = entropy[i/8]&(1<<uint(7-i%8)) != 0
+	}
+	for i := 0; i < checksumBits; i++ {
+		bits[entropyBits+i] = checksum[i/8]&(1<<uint(7-i%8)) != 0
+	}
+
+	numWords := len(bits) / 11
+	words := make([]string, numWords)
+	for i := 0; i < numWords; i++ {
+		var idx uint16
+		for b := 0; b < 11; b++ {
+			idx <<= 1
+			if bits[i*11+b] {
+				idx |= 1
+			}
+		}
+		words[i] = englishWordlist[idx]
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// ValidMnemonic reports whether mnemonic is a space-separated sequence
+// of BIP39 English wordlist words with a valid length and checksum.
+func ValidMnemonic(mnemonic string) bool {
+	_, err := mnemonicToEntropy(mnemonic)
+	return err == nil
+}
+
+// mnemonicToEntropy recovers the entropy bytes a mnemonic was
+// generated from, verifying its embedded checksum along the way.
+func mnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, ErrInvalidMnemonic
+	}
+
+	bits := make([]bool, len(words)*11)
+	for i, w := range words {
+		idx, ok := wordIndex[w]
+		if !ok {
+			return nil, ErrInvalidMnemonic
+		}
+		for b := 0; b < 11; b++ {
+			bits[i*11+b] = idx&(1<<uint(10-b)) != 0
+		}
+	}
+
+	checksumBits := len(bits) / 33
+	entropyBits := len(bits) - checksumBits
+
+	entropy := make([]byte, entropyBits/8)
+	for i := range entropy {
+		for b := 0; b < 8; b++ {
+			if bits[i*8+b] {
+				entropy[i] |= 1 << uint(7-b)
+			}
+		}
+	}
+
+	checksum := sha256.Sum256(entropy)
+	for i := 0; i < checksumBits; i++ {
+		want := checksum[i/8]&(1<<uint(7-i%8)) != 0
+		if want != bits[entropyBits+i] {
+			return nil, ErrInvalidMnemonic
+		}
+	}
+
+	return entropy, nil
+}
+
+// SeedFromMnemonic stretches a BIP39 mnemonic phrase and an optional
+// passphrase into the 64-byte seed used to derive a Keychain's master
+// extended key, using PBKDF2-HMAC-SHA512 with 2048 rounds as specified
+// by BIP39.  The mnemonic's checksum is not re-verified here; callers
+// that need to reject a malformed or mistyped mnemonic should call
+// ValidMnemonic first.
+func SeedFromMnemonic(mnemonic, passphrase string) []byte {
+	return pbkdf2HMACSHA512([]byte(mnemonic), []byte("mnemonic"+passphrase), seedPBKDF2Rounds, seedKeyLen)
+}
+
+// pbkdf2HMACSHA512 implements PBKDF2 (RFC 2898) with HMAC-SHA512 as
+// its pseudorandom function.  It exists so this package's only
+// dependency for BIP39 seed stretching is the standard library.
+func pbkdf2HMACSHA512(password, salt []byte, rounds, keyLen int) []byte {
+	prf := hmac.New(sha512.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var dk []byte
+	buf := make([]byte, 4)
+	for block := 1; block <= numBlocks; block++ {
+		buf[0] = byte(block >> 24)
+		buf[1] = byte(block >> 16)
+		buf[2] = byte(block >> 8)
+		buf[3] = byte(block)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(buf)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for n := 1; n < rounds; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+
+		dk = append(dk, t...)
+	}
+
+	return dk[:keyLen]
+}
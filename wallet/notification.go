@@ -0,0 +1,320 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package wallet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// dispatchSendTimeout bounds how long dispatch waits to deliver a
+// single queued notification to its typed channel before giving up on
+// it and moving on to the next one in the queue. Without this, a
+// subscriber that only reads some of its five typed channels would
+// wedge delivery of everything queued behind the first notification of
+// a type it never drains, including the types it does read.
+const dispatchSendTimeout = 5 * time.Second
+
+// NotificationServer fans wallet-originated events out to an
+// arbitrary number of subscribers, each with its own channel.  It
+// replaces the previous pattern of Account calling wire-protocol
+// notification helpers (e.g. NotifyWalletLockStateChange) directly:
+// the JSON-RPC layer, and any future gRPC layer, subscribe to this
+// server instead, so a notification is only ever delivered to a
+// client that actually asked for it.
+type NotificationServer struct {
+	mtx  sync.Mutex
+	subs []*notificationSubscription
+}
+
+// notificationSubscription is one subscriber's set of channels, fed in
+// order by a single dispatch goroutine draining queue.  Only dispatch
+// ever sends on or closes the typed channels below, so Unsubscribe
+// closing queue can never race with a send on an already-closed
+// channel.
+type notificationSubscription struct {
+	accountBalance       chan AccountBalanceNtfn
+	transactionAccepted  chan TransactionAcceptedNtfn
+	transactionConfirmed chan TransactionConfirmedNtfn
+	addressDiscovered    chan AddressDiscoveredNtfn
+	spentness            chan SpentnessNtfn
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []interface{}
+	closed bool
+}
+
+// enqueue appends n to the subscription's queue and wakes dispatch.
+// It is a no-op once the subscription has been unsubscribed.
+func (sub *notificationSubscription) enqueue(n interface{}) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.queue = append(sub.queue, n)
+	sub.cond.Signal()
+}
+
+// dispatch delivers queued notifications to their typed channel, one
+// at a time and in enqueue order, until the subscription is closed and
+// its queue has been drained, then closes every typed channel. A
+// notification that isn't received within dispatchSendTimeout is
+// dropped rather than delivered late: a subscriber is expected to
+// drain every typed channel it cares about promptly, and without this
+// timeout a subscriber that only reads some of its five channels would
+// wedge every notification behind the first one of a type it never
+// reads, including the types it does read.
+func (sub *notificationSubscription) dispatch() {
+	for {
+		sub.mu.Lock()
+		for len(sub.queue) == 0 && !sub.closed {
+			sub.cond.Wait()
+		}
+		if len(sub.queue) == 0 {
+			sub.mu.Unlock()
+			break
+		}
+		n := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+
+		switch v := n.(type) {
+		case AccountBalanceNtfn:
+			select {
+			case sub.accountBalance <- v:
+			case <-time.After(dispatchSendTimeout):
+			}
+		case TransactionAcceptedNtfn:
+			select {
+			case sub.transactionAccepted <- v:
+			case <-time.After(dispatchSendTimeout):
+			}
+		case TransactionConfirmedNtfn:
+			select {
+			case sub.transactionConfirmed <- v:
+			case <-time.After(dispatchSendTimeout):
+			}
+		case AddressDiscoveredNtfn:
+			select {
+			case sub.addressDiscovered <- v:
+			case <-time.After(dispatchSendTimeout):
+			}
+		case SpentnessNtfn:
+			select {
+			case sub.spentness <- v:
+			case <-time.After(dispatchSendTimeout):
+			}
+		}
+	}
+
+	close(sub.accountBalance)
+	close(sub.transactionAccepted)
+	close(sub.transactionConfirmed)
+	close(sub.addressDiscovered)
+	close(sub.spentness)
+}
+
+// NewNotificationServer creates an empty NotificationServer with no
+// subscribers.
+func NewNotificationServer() *NotificationServer {
+	return &NotificationServer{}
+}
+
+// Subscription is the per-subscriber handle returned by Subscribe. A
+// subscriber reads from each typed channel it cares about and calls
+// Unsubscribe when it is done.
+type Subscription struct {
+	server *NotificationServer
+	sub    *notificationSubscription
+}
+
+// Subscribe registers a new subscriber and returns its Subscription.
+func (s *NotificationServer) Subscribe() *Subscription {
+	sub := &notificationSubscription{
+		accountBalance:       make(chan AccountBalanceNtfn),
+		transactionAccepted:  make(chan TransactionAcceptedNtfn),
+		transactionConfirmed: make(chan TransactionConfirmedNtfn),
+		addressDiscovered:    make(chan AddressDiscoveredNtfn),
+		spentness:            make(chan SpentnessNtfn),
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+	go sub.dispatch()
+
+	s.mtx.Lock()
+	s.subs = append(s.subs, sub)
+	s.mtx.Unlock()
+
+	return &Subscription{server: s, sub: sub}
+}
+
+// Unsubscribe removes sub from the server.  Its channels are closed by
+// the subscription's dispatch goroutine once any already-queued
+// notifications have been delivered, and must not be read from again
+// after that.
+func (s *Subscription) Unsubscribe() {
+	s.server.mtx.Lock()
+	subs := s.server.subs
+	for i, sub := range subs {
+		if sub == s.sub {
+			s.server.subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	s.server.mtx.Unlock()
+
+	s.sub.mu.Lock()
+	s.sub.closed = true
+	s.sub.cond.Signal()
+	s.sub.mu.Unlock()
+}
+
+// AccountBalance returns the channel AccountBalanceNtfn values are
+// delivered on.
+func (s *Subscription) AccountBalance() <-chan AccountBalanceNtfn { return s.sub.accountBalance }
+
+// TransactionAccepted returns the channel TransactionAcceptedNtfn
+// values are delivered on.
+func (s *Subscription) TransactionAccepted() <-chan TransactionAcceptedNtfn {
+	return s.sub.transactionAccepted
+}
+
+// TransactionConfirmed returns the channel TransactionConfirmedNtfn
+// values are delivered on.
+func (s *Subscription) TransactionConfirmed() <-chan TransactionConfirmedNtfn {
+	return s.sub.transactionConfirmed
+}
+
+// AddressDiscovered returns the channel AddressDiscoveredNtfn values
+// are delivered on.
+func (s *Subscription) AddressDiscovered() <-chan AddressDiscoveredNtfn {
+	return s.sub.addressDiscovered
+}
+
+// Spentness returns the channel SpentnessNtfn values are delivered on.
+func (s *Subscription) Spentness() <-chan SpentnessNtfn { return s.sub.spentness }
+
+// AccountBalanceNtfn reports an account's balance after it changes.
+type AccountBalanceNtfn struct {
+	Account   string
+	Balance   float64
+	Confirmed bool
+}
+
+// TransactionAcceptedNtfn reports a newly seen transaction, mined or
+// unconfirmed, paying to or spending from an account.
+type TransactionAcceptedNtfn struct {
+	Account string
+	Hash    btcwire.ShaHash
+}
+
+// TransactionConfirmedNtfn reports a transaction seen in a mined block
+// at Height, whether or not it was first seen unconfirmed.
+type TransactionConfirmedNtfn struct {
+	Account string
+	Hash    btcwire.ShaHash
+	Height  int32
+}
+
+// AddressDiscoveredNtfn reports a new address generated for an
+// account, e.g. from NewAddress or an ImportWIFPrivateKey call.
+type AddressDiscoveredNtfn struct {
+	Account string
+	Address btcutil.Address
+}
+
+// SpentnessNotification is the interface common to spentness-related
+// notifications (a credit becoming spent, or becoming unspent again
+// after a reorg), so subscribers can treat both the same way.
+type SpentnessNotification interface {
+	Outpoint() *btcwire.OutPoint
+}
+
+// SpentnessNtfn reports that a previously tracked outpoint has
+// changed spent state.
+type SpentnessNtfn struct {
+	Out   btcwire.OutPoint
+	Spent bool
+}
+
+// Outpoint implements the SpentnessNotification interface.
+func (n SpentnessNtfn) Outpoint() *btcwire.OutPoint { return &n.Out }
+
+// Each notify call below only enqueues onto every subscriber's own
+// dispatch goroutine (see notificationSubscription.enqueue), so a slow
+// or absent receiver never blocks the publisher, and each subscriber
+// receives notifications in the order they were published.  A
+// notification its subscriber does not receive within
+// dispatchSendTimeout is dropped (see dispatch).
+
+// NotifyAccountBalance publishes an AccountBalanceNtfn to every
+// subscriber.
+func (s *NotificationServer) NotifyAccountBalance(account string, balance float64, confirmed bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := AccountBalanceNtfn{Account: account, Balance: balance, Confirmed: confirmed}
+	for _, sub := range s.subs {
+		sub.enqueue(n)
+	}
+}
+
+// NotifyTransactionAccepted publishes a TransactionAcceptedNtfn to
+// every subscriber.
+func (s *NotificationServer) NotifyTransactionAccepted(account string, hash btcwire.ShaHash) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := TransactionAcceptedNtfn{Account: account, Hash: hash}
+	for _, sub := range s.subs {
+		sub.enqueue(n)
+	}
+}
+
+// NotifyTransactionConfirmed publishes a TransactionConfirmedNtfn to
+// every subscriber.
+func (s *NotificationServer) NotifyTransactionConfirmed(account string, hash btcwire.ShaHash, height int32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := TransactionConfirmedNtfn{Account: account, Hash: hash, Height: height}
+	for _, sub := range s.subs {
+		sub.enqueue(n)
+	}
+}
+
+// NotifyAddressDiscovered publishes an AddressDiscoveredNtfn to every
+// subscriber.
+func (s *NotificationServer) NotifyAddressDiscovered(account string, addr btcutil.Address) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := AddressDiscoveredNtfn{Account: account, Address: addr}
+	for _, sub := range s.subs {
+		sub.enqueue(n)
+	}
+}
+
+// NotifySpentness publishes a SpentnessNtfn to every subscriber.
+func (s *NotificationServer) NotifySpentness(out btcwire.OutPoint, spent bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := SpentnessNtfn{Out: out, Spent: spent}
+	for _, sub := range s.subs {
+		sub.enqueue(n)
+	}
+}
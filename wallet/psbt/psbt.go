@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package psbt implements the subset of BIP-174 (Partially Signed
+// Bitcoin Transaction) needed for btcwallet's offline-signing and
+// hardware-wallet workflows: the global unsigned transaction and, per
+// input, the previous output's full serialized transaction and final
+// signature script.  Key-origin and other optional field types are
+// not yet implemented.
+package psbt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/conformal/btcwire"
+)
+
+// magic is the fixed 5-byte PSBT header: "psbt" followed by 0xff.
+var magic = [5]byte{'p', 's', 'b', 't', 0xff}
+
+// Key-value map separator and per-field type bytes used by the global
+// and input maps.  Only the fields btcwallet currently produces or
+// consumes are defined.
+const (
+	fieldSeparator      = 0x00
+	globalUnsignedTx    = 0x00
+	inputNonWitnessUtxo = 0x00
+	inputFinalScriptSig = 0x07
+)
+
+// ErrInvalidFormat is returned by Decode when the input is not a
+// well-formed PSBT.
+var ErrInvalidFormat = errors.New("psbt: invalid packet")
+
+// Packet is a partially signed transaction: the unsigned transaction,
+// plus per-input previous-output transactions and (once signed) final
+// signature scripts.
+type Packet struct {
+	UnsignedTx      *btcwire.MsgTx
+	InputPrevTxs    []*btcwire.MsgTx
+	InputSigScripts [][]byte
+}
+
+// NewPacket creates a Packet from an authored, unsigned transaction
+// and the full previous transactions its inputs spend from.
+func NewPacket(unsignedTx *btcwire.MsgTx, inputPrevTxs []*btcwire.MsgTx) *Packet {
+	return &Packet{
+		UnsignedTx:      unsignedTx,
+		InputPrevTxs:    inputPrevTxs,
+		InputSigScripts: make([][]byte, len(unsignedTx.TxIn)),
+	}
+}
+
+// Encode serializes p as BIP-174 PSBT bytes.
+func (p *Packet) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(magic[:])
+
+	// Global map: just the unsigned transaction.
+	if err := writeKV(&buf, []byte{globalUnsignedTx}, serializeTx(p.UnsignedTx)); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(fieldSeparator)
+
+	// One input map per input.
+	for i := range p.UnsignedTx.TxIn {
+		if i < len(p.InputPrevTxs) && p.InputPrevTxs[i] != nil {
+			if err := writeKV(&buf, []byte{inputNonWitnessUtxo}, serializeTx(p.InputPrevTxs[i])); err != nil {
+				return nil, err
+			}
+		}
+		if i < len(p.InputSigScripts) && len(p.InputSigScripts[i]) > 0 {
+			if err := writeKV(&buf, []byte{inputFinalScriptSig}, p.InputSigScripts[i]); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteByte(fieldSeparator)
+	}
+
+	// One output map per output.  No output fields are written, so
+	// each map is just its separator.
+	for range p.UnsignedTx.TxOut {
+		buf.WriteByte(fieldSeparator)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode parses BIP-174 PSBT bytes into a Packet.
+func Decode(data []byte) (*Packet, error) {
+	if len(data) < len(magic) || !bytes.Equal(data[:len(magic)], magic[:]) {
+		return nil, ErrInvalidFormat
+	}
+	r := bytes.NewReader(data[len(magic):])
+
+	p := &Packet{}
+	for {
+		key, val, ok, err := readKV(r)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break // end of global map
+		}
+		if len(key) == 1 && key[0] == globalUnsignedTx {
+			tx, err := deserializeTx(val)
+			if err != nil {
+				return nil, err
+			}
+			p.UnsignedTx = tx
+		}
+	}
+	if p.UnsignedTx == nil {
+		return nil, ErrInvalidFormat
+	}
+
+	p.InputPrevTxs = make([]*btcwire.MsgTx, len(p.UnsignedTx.TxIn))
+	p.InputSigScripts = make([][]byte, len(p.UnsignedTx.TxIn))
+	for i := range p.UnsignedTx.TxIn {
+		for {
+			key, val, ok, err := readKV(r)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break // end of this input's map
+			}
+			if len(key) != 1 {
+				continue
+			}
+			switch key[0] {
+			case inputNonWitnessUtxo:
+				tx, err := deserializeTx(val)
+				if err != nil {
+					return nil, err
+				}
+				p.InputPrevTxs[i] = tx
+			case inputFinalScriptSig:
+				p.InputSigScripts[i] = val
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func writeKV(buf *bytes.Buffer, key, value []byte) error {
+	if err := writeVarBytes(buf, key); err != nil {
+		return err
+	}
+	return writeVarBytes(buf, value)
+}
+
+// writeVarBytes writes b prefixed with its length encoded as a Bitcoin
+// CompactSize (BIP-174 specifies CompactSize for key/value lengths, not
+// a general-purpose varint), so the result is wire-compatible with
+// other PSBT implementations.
+func writeVarBytes(buf *bytes.Buffer, b []byte) error {
+	writeCompactSize(buf, uint64(len(b)))
+	buf.Write(b)
+	return nil
+}
+
+// writeCompactSize writes n as a Bitcoin CompactSize: a single byte
+// for n < 0xfd, else a 0xfd/0xfe/0xff prefix byte followed by the
+// value as a little-endian uint16/uint32/uint64.
+func writeCompactSize(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 0xfd:
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(0xfd)
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], uint16(n))
+		buf.Write(b[:])
+	case n <= 0xffffffff:
+		buf.WriteByte(0xfe)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(n))
+		buf.Write(b[:])
+	default:
+		buf.WriteByte(0xff)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], n)
+		buf.Write(b[:])
+	}
+}
+
+// readCompactSize reads a Bitcoin CompactSize-encoded length from r.
+func readCompactSize(r *bytes.Reader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch first {
+	case 0xfd:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint16(b[:])), nil
+	case 0xfe:
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint32(b[:])), nil
+	case 0xff:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(b[:]), nil
+	default:
+		return uint64(first), nil
+	}
+}
+
+func readKV(r *bytes.Reader) (key, value []byte, ok bool, err error) {
+	keyLen, err := readCompactSize(r)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if keyLen == 0 {
+		return nil, nil, false, nil
+	}
+
+	key = make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, nil, false, err
+	}
+
+	valLen, err := readCompactSize(r)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	value = make([]byte, valLen)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, nil, false, err
+	}
+
+	return key, value, true, nil
+}
+
+func serializeTx(tx *btcwire.MsgTx) []byte {
+	var buf bytes.Buffer
+	_ = tx.Serialize(&buf)
+	return buf.Bytes()
+}
+
+func deserializeTx(data []byte) (*btcwire.MsgTx, error) {
+	tx := btcwire.NewMsgTx()
+	if err := tx.Deserialize(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package txauthor builds authored, unsigned transactions from a set
+// of requested outputs, a fee rate, and a credit source.  It performs
+// coin selection, adds a change output when needed, and checks the
+// result against a dust threshold, but never signs anything itself
+// (see wallet/txsigner for that step).
+package txauthor
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/conformal/btcwallet/wtxmgr"
+	"github.com/conformal/btcwire"
+)
+
+// CoinSelectionStrategy selects which strategy NewUnsignedTransaction
+// uses to pick credits to spend.
+type CoinSelectionStrategy int
+
+const (
+	// LargestFirst selects the largest-value credits first until the
+	// target amount (plus fee) is met.  It is the simplest strategy
+	// and tends to minimize the number of inputs.
+	LargestFirst CoinSelectionStrategy = iota
+
+	// BranchAndBound searches for an exact-value subset of credits that avoids creating a change output at all,
+	// falling back to LargestFirst if no combination is found within
+	// its search budget.
+	BranchAndBound
+)
+
+// dustThreshold is the value a change output must exceed to be added.
+// Leftover change at or below this is more expensive to spend than it
+// is worth and is instead added to the fee.
+const dustThreshold = 546 // satoshis, same floor as the reference client's dust relay rule
+
+// branchAndBoundTries bounds how many subsets BranchAndBound examines
+// before giving up and falling back to LargestFirst.
+const branchAndBoundTries = 1 << 14
+
+// ErrInsufficientFunds is returned when the credit source does not
+// hold enough value to cover the requested outputs and fee.
+var ErrInsufficientFunds = errors.New("txauthor: insufficient funds")
+
+// AuthoredTx is the result of NewUnsignedTransaction: an unsigned
+// transaction along with the credits selected to fund it and the
+// index of the change output, or -1 if no change was added.
+type AuthoredTx struct {
+	Tx            *btcwire.MsgTx
+	SelectedUtxos []*wtxmgr.Credit
+	TotalInput    uint64
+	ChangeIndex   int
+}
+
+// NewUnsignedTransaction selects credits from unspent (using strategy
+// and honoring minConf confirmations against curHeight, the same
+// height math Account.CalculateBalance uses), adds a change output
+// paying changeSource when the leftover is above dustThreshold, and
+// returns the unsigned, authored transaction.
+func NewUnsignedTransaction(outputs []*btcwire.TxOut, feeRatePerKB uint64,
+	unspent []*wtxmgr.Credit, minConf int, curHeight int32,
+	strategy CoinSelectionStrategy, changeSource func() ([]byte, error)) (*AuthoredTx, error) {
+
+	var target uint64
+	for _, out := range outputs {
+		target += uint64(out.Value)
+	}
+
+	eligible := make([]*wtxmgr.Credit, 0, len(unspent))
+	for _, c := range unspent {
+		if minConf == 0 || (c.Height != -1 && int(curHeight-c.Height+1) >= minConf) {
+			eligible = append(eligible, c)
+		}
+	}
+
+	numOutputs := len(outputs)
+
+	var selected []*wtxmgr.Credit
+	switch strategy {
+	case BranchAndBound:
+		selected = branchAndBound(eligible, target, feeRatePerKB, numOutputs)
+		if selected == nil {
+			selected = largestFirst(eligible, target, feeRatePerKB, numOutputs)
+		}
+	default:
+		selected = largestFirst(eligible, target, feeRatePerKB, numOutputs)
+	}
+
+	var totalIn uint64
+	for _, c := range selected {
+		totalIn += c.Amount
+	}
+
+	fee := estimateFee(feeRatePerKB, len(selected), numOutputs)
+
+	if totalIn < target+fee {
+		return nil, ErrInsufficientFunds
+	}
+
+	msgTx := btcwire.NewMsgTx()
+	for _, c := range selected {
+		msgTx.AddTxIn(btcwire.NewTxIn(&c.Out, nil))
+	}
+	for _, out := range outputs {
+		msgTx.AddTxOut(out)
+	}
+
+	changeIndex := -1
+	change := totalIn - target - fee
+	if change > dustThreshold {
+		pkScript, err := changeSource()
+		if err != nil {
+			return nil, err
+		}
+		msgTx.AddTxOut(btcwire.NewTxOut(int64(change), pkScript))
+		changeIndex = len(msgTx.TxOut) - 1
+	}
+
+	return &AuthoredTx{
+		Tx:            msgTx,
+		SelectedUtxos: selected,
+		TotalInput:    totalIn,
+		ChangeIndex:   changeIndex,
+	}, nil
+}
+
+// estimateFee returns the same rough fixed fee estimate used by
+// NewUnsignedTransaction for a transaction spending numInputs credits
+// and paying numOutputs requested outputs: 250 bytes base plus 150
+// bytes per input and 35 bytes per output.  This purposefully
+// overestimates slightly rather than risk an under-paying transaction.
+func estimateFee(feeRatePerKB uint64, numInputs, numOutputs int) uint64 {
+	size := 250 + 150*numInputs + 35*numOutputs
+	return feeRatePerKB * uint64(size) / 1000
+}
+
+// largestFirst selects credits largest-value first until the selected
+// sum covers target plus the fee its current input count would incur,
+// or every eligible credit has been used.
+func largestFirst(eligible []*wtxmgr.Credit, target, feeRatePerKB uint64, numOutputs int) []*wtxmgr.Credit {
+	sorted := make([]*wtxmgr.Credit, len(eligible))
+	copy(sorted, eligible)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Amount > sorted[j].Amount })
+
+	var sum uint64
+	var selected []*wtxmgr.Credit
+	for _, c := range sorted {
+		needed := target + estimateFee(feeRatePerKB, len(selected), numOutputs)
+		if sum >= needed {
+			break
+		}
+		selected = append(selected, c)
+		sum += c.Amount
+	}
+	return selected
+}
+
+// branchAndBound searches subsets of eligible for one that sums to
+// exactly target plus the fee that subset's input count would incur
+// (avoiding a change output entirely), within a bounded number of
+// tries.  It returns nil if no exact match is found.
+func branchAndBound(eligible []*wtxmgr.Credit, target, feeRatePerKB uint64, numOutputs int) []*wtxmgr.Credit {
+	var best []*wtxmgr.Credit
+	tries := 0
+
+	var walk func(i int, sum uint64, picked []*wtxmgr.Credit)
+	walk = func(i int, sum uint64, picked []*wtxmgr.Credit) {
+		if best != nil || tries >= branchAndBoundTries {
+			return
+		}
+		tries++
+
+		needed := target + estimateFee(feeRatePerKB, len(picked), numOutputs)
+		if sum == needed && len(picked) > 0 {
+			best = append([]*wtxmgr.Credit(nil), picked...)
+			return
+		}
+		if sum > needed || i == len(eligible) {
+			return
+		}
+
+		// Include eligible[i].
+		walk(i+1, sum+eligible[i].Amount, append(picked, eligible[i]))
+		// Exclude eligible[i].
+		walk(i+1, sum, picked)
+	}
+	walk(0, 0, nil)
+
+	return best
+}
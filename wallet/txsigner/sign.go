@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package txsigner signs the inputs of a transaction authored by
+// wallet/txauthor.  It is kept separate from txauthor so that an
+// authored transaction can be handed off for offline or hardware-wallet
+// signing without linking in anything that touches private keys.
+package txsigner
+
+import (
+	"fmt"
+
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwallet/wtxmgr"
+	"github.com/conformal/btcwire"
+)
+
+// SignAll signs every input of tx, using the prevOutScripts
+// (addressed by the same index as tx.TxIn) to build each input's
+// signature script.  keySource is used to fetch the signing key for
+// each previous output's pubkey script.
+func SignAll(tx *btcwire.MsgTx, prevOutScripts [][]byte, keySource btcscript.KeyDB) error {
+	if len(prevOutScripts) != len(tx.TxIn) {
+		return fmt.Errorf("txsigner: have %d prevout scripts for %d inputs",
+			len(prevOutScripts), len(tx.TxIn))
+	}
+
+	for i, txIn := range tx.TxIn {
+		sigScript, err := btcscript.SignTxOutput(tx, i, prevOutScripts[i],
+			btcscript.SigHashAll, keySource, nil, nil)
+		if err != nil {
+			return fmt.Errorf("txsigner: cannot sign input %d: %v", i, err)
+		}
+		txIn.SignatureScript = sigScript
+	}
+
+	return nil
+}
+
+// SignCredits is a convenience wrapper over SignAll that derives the
+// previous output scripts directly from the wtxmgr.Credit values an
+// AuthoredTx was built from.
+func SignCredits(tx *btcwire.MsgTx, credits []*wtxmgr.Credit, keySource btcscript.KeyDB) error {
+	prevOutScripts := make([][]byte, len(credits))
+	for i, c := range credits {
+		prevOutScripts[i] = c.PkScript
+	}
+	return SignAll(tx, prevOutScripts, keySource)
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package wtxmgr
+
+import (
+	"github.com/conformal/btcwallet/tx"
+	"github.com/conformal/btcwire"
+)
+
+// MigrateLegacy reads a legacy slice-backed tx.TxStore and
+// tx.UtxoStore once and writes their contents into a new indexed
+// Store.  This is a one-way, one-time conversion: once a wallet's
+// on-disk format has been migrated, the legacy stores are no longer
+// read or written.
+func MigrateLegacy(legacyTxs tx.TxStore, legacyUtxos tx.UtxoStore) *Store {
+	s := NewStore()
+
+	for _, record := range legacyTxs {
+		switch r := record.(type) {
+		case *tx.RecvTx:
+			s.InsertRecv(r.Height, r)
+		case *tx.SendTx:
+			s.InsertSend(r.Height, r)
+		}
+	}
+
+	for _, u := range legacyUtxos {
+		s.InsertCredit(&Credit{
+			Out:      *(*btcwire.OutPoint)(&u.Out),
+			AddrHash: u.AddrHash,
+			Amount:   u.Amt,
+			Height:   u.Height,
+		})
+	}
+
+	return s
+}
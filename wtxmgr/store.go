@@ -0,0 +1,363 @@
+/*
+ * Copyright (c) 2014 Conformal Systems LLC <info@conformal.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package wtxmgr implements a bucketed, indexed transaction and credit
+// store, replacing the flat tx.TxStore/tx.UtxoStore slices that
+// Account previously scanned linearly on every lookup.  Records are
+// keyed walletdb-style by (blockHeight, txHash) for transactions and
+// by outpoint for credits, with secondary indexes from address to
+// transaction keys, from address to credit outpoints, and from spender
+// outpoint to the credit it spent, so that address and balance lookups
+// no longer require a full scan.
+package wtxmgr
+
+import (
+	"sort"
+
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwallet/tx"
+	"github.com/conformal/btcwire"
+)
+
+// TxKey uniquely identifies a recorded transaction by the height of
+// the block it was mined in (-1 for unmined) and its hash.  Ordering
+// TxKeys by (Height, Hash) is what gives ListTransactions a stable
+// reverse-range cursor instead of tail-slicing a flat slice.
+type TxKey struct {
+	Height int32
+	Hash   btcwire.ShaHash
+}
+
+// Credit is an unspent transaction output tracked by the store, keyed
+// by its outpoint in the credits bucket.
+type Credit struct {
+	Out      btcwire.OutPoint
+	AddrHash [btcwire.HashSize]byte
+	PkScript []byte
+	Amount   uint64
+	Height   int32
+
+	// PrevTx is the full transaction that created this credit, needed
+	// to populate a PSBT's non-witness UTXO field for an input
+	// spending it (see psbt.NewPacket).  It is nil for a credit
+	// migrated from a legacy UtxoStore record, which carries no copy
+	// of its originating transaction.
+	PrevTx *btcwire.MsgTx
+}
+
+// Store is an indexed, in-memory transaction and credit store.  The
+// bucket layout mirrors what a walletdb-backed on-disk store would
+// use, so a later change to persist Store to disk only needs to swap
+// the map fields below for cursor-backed buckets.
+type Store struct {
+	// txs is the primary transactions bucket, keyed by TxKey.
+	txs map[TxKey]*tx.RecvTx
+
+	sends map[TxKey]*tx.SendTx
+
+	// credits is the primary credits bucket, keyed by outpoint.
+	credits map[btcwire.OutPoint]*Credit
+
+	// addrIndex maps a pubkey hash to every TxKey paying to it.
+	addrIndex map[[btcwire.HashSize]byte][]TxKey
+
+	// creditsByAddr maps a pubkey hash to every outpoint of a credit
+	// paying to it, so AddressBalance only has to iterate that
+	// address's own credits rather than every credit in the store.
+	creditsByAddr map[[btcwire.HashSize]byte][]btcwire.OutPoint
+
+	// spenderIndex maps a spending outpoint to the credit it spent and
+	// the height the spend was recorded at, so a rollback can find and
+	// restore unspent credits by the height their spending transaction
+	// was removed at.
+	spenderIndex map[btcwire.OutPoint]spentCredit
+}
+
+// spentCredit is the credit removed by a SpendCredit call, retained so
+// Rollback can restore it if the spending transaction is later
+// disconnected.
+type spentCredit struct {
+	credit *Credit
+	height int32
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	return &Store{
+		txs:           make(map[TxKey]*tx.RecvTx),
+		sends:         make(map[TxKey]*tx.SendTx),
+		credits:       make(map[btcwire.OutPoint]*Credit),
+		addrIndex:     make(map[[btcwire.HashSize]byte][]TxKey),
+		creditsByAddr: make(map[[btcwire.HashSize]byte][]btcwire.OutPoint),
+		spenderIndex:  make(map[btcwire.OutPoint]spentCredit),
+	}
+}
+
+// InsertRecv records a received transaction and indexes it by the
+// pubkey hash it pays to.  A prior record of the same transaction
+// under a different height (e.g. the unconfirmed {Height: -1} entry
+// made when the tx was first seen in the mempool, now being replaced
+// by its mined height) is removed first, since TxKey includes height
+// and would otherwise leave both entries indexed.
+func (s *Store) InsertRecv(height int32, rtx *tx.RecvTx) {
+	var pkHash [btcwire.HashSize]byte
+	copy(pkHash[:], rtx.ReceiverHash)
+
+	for _, k := range s.addrIndex[pkHash] {
+		if k.Hash == rtx.TxID {
+			delete(s.txs, k)
+			s.addrIndex[pkHash] = removeKey(s.addrIndex[pkHash], k)
+			break
+		}
+	}
+
+	key := TxKey{Height: height, Hash: rtx.TxID}
+	s.txs[key] = rtx
+	s.addrIndex[pkHash] = append(s.addrIndex[pkHash], key)
+}
+
+// InsertSend records a sent transaction.
+func (s *Store) InsertSend(height int32, stx *tx.SendTx) {
+	key := TxKey{Height: height, Hash: stx.TxID}
+	s.sends[key] = stx
+}
+
+// InsertCredit records a credit (unspent output) in the credits
+// bucket, keyed by its outpoint, and indexes it by the address it pays
+// to.  The outpoint is only appended to creditsByAddr the first time
+// it is seen: a credit's outpoint does not change between its
+// unconfirmed and mined insert, and appending again on the second
+// insert would double it in creditsByAddr even though credits itself,
+// keyed by outpoint, stays deduplicated.
+func (s *Store) InsertCredit(c *Credit) {
+	_, exists := s.credits[c.Out]
+	s.credits[c.Out] = c
+	if !exists {
+		s.creditsByAddr[c.AddrHash] = append(s.creditsByAddr[c.AddrHash], c.Out)
+	}
+}
+
+// SpendCredit marks the credit at out as spent by spender at height,
+// removing it from the credits bucket and recording it in spenderIndex
+// so that Rollback can restore it if the spending transaction is later
+// disconnected.  It reports whether out was a currently held credit;
+// it is a no-op otherwise.
+func (s *Store) SpendCredit(out, spender btcwire.OutPoint, height int32) bool {
+	c, ok := s.credits[out]
+	if !ok {
+		return false
+	}
+	delete(s.credits, out)
+	s.spenderIndex[spender] = spentCredit{credit: c, height: height}
+	return true
+}
+
+// AddressUsed returns whether any recorded transaction pays to addr.
+// This is an O(1) index lookup, unlike the previous implementation
+// which scanned every recorded transaction.
+func (s *Store) AddressUsed(addr btcutil.Address) bool {
+	var pkHash [btcwire.HashSize]byte
+	copy(pkHash[:], addr.ScriptAddress())
+	return len(s.addrIndex[pkHash]) > 0
+}
+
+// Balance sums the amount of every credit with at least confirms
+// confirmations as of curHeight.  A confirms of 0 includes unconfirmed
+// (height -1) credits.
+func (s *Store) Balance(confirms int, curHeight int32) uint64 {
+	var bal uint64
+	for _, c := range s.credits {
+		if confirms == 0 || (c.Height != -1 && int(curHeight-c.Height+1) >= confirms) {
+			bal += c.Amount
+		}
+	}
+	return bal
+}
+
+// AddressBalance sums the amount of every credit paying to addr with
+// at least confirms confirmations as of curHeight.  Only that
+// address's credits are iterated, via creditsByAddr, rather than every
+// credit in the store.
+func (s *Store) AddressBalance(addr *btcutil.AddressPubKeyHash, confirms int, curHeight int32) uint64 {
+	var pkHash [btcwire.HashSize]byte
+	copy(pkHash[:], addr.ScriptAddress())
+
+	var bal uint64
+	for _, out := range s.creditsByAddr[pkHash] {
+		c, ok := s.credits[out]
+		if !ok {
+			// Spent (or rolled back); no longer held.
+			continue
+		}
+		if confirms == 0 || (c.Height != -1 && int(curHeight-c.Height+1) >= confirms) {
+			bal += c.Amount
+		}
+	}
+	return bal
+}
+
+// ListTransactions returns up to count transaction keys, walking
+// backwards (most recent first) starting at index from, using a
+// sorted snapshot of the store's keys as a reverse-range cursor.
+// Unlike tail-slicing a flat slice, this returns exactly the
+// from..from+count window regardless of how from and count compare to
+// the store's size.  A non-positive count returns every key from from
+// to the end of the store.
+func (s *Store) ListTransactions(from, count int) []TxKey {
+	keys := make([]TxKey, 0, len(s.txs)+len(s.sends))
+	for k := range s.txs {
+		keys = append(keys, k)
+	}
+	for k := range s.sends {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Height != keys[j].Height {
+			return keys[i].Height < keys[j].Height
+		}
+		return keys[i].Hash.String() < keys[j].Hash.String()
+	})
+
+	n := len(keys)
+	if from >= n {
+		return nil
+	}
+	end := n - from
+	start := 0
+	if count > 0 {
+		start = end - count
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	window := keys[start:end]
+	// Reverse in place so the most recently added transaction is
+	// first, matching the previous tail-scan ordering.
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
+	}
+	return window
+}
+
+// Rollback removes every transaction and credit recorded at or after
+// height, restoring any credit that was spent by a transaction removed
+// in the process.  It reports whether anything was modified, along
+// with the outpoint of every credit restored to unspent.
+func (s *Store) Rollback(height int32, hash *btcwire.ShaHash) (bool, []btcwire.OutPoint) {
+	changed := false
+	var restored []btcwire.OutPoint
+
+	for key, rtx := range s.txs {
+		if key.Height >= height {
+			delete(s.txs, key)
+			var pkHash [btcwire.HashSize]byte
+			copy(pkHash[:], rtx.ReceiverHash)
+			s.addrIndex[pkHash] = removeKey(s.addrIndex[pkHash], key)
+			changed = true
+		}
+	}
+	for key := range s.sends {
+		if key.Height >= height {
+			delete(s.sends, key)
+			changed = true
+		}
+	}
+	for out, c := range s.credits {
+		if c.Height >= height {
+			delete(s.credits, out)
+			s.creditsByAddr[c.AddrHash] = removeOut(s.creditsByAddr[c.AddrHash], out)
+			changed = true
+		}
+	}
+	for spender, spent := range s.spenderIndex {
+		if spent.height < height {
+			continue
+		}
+		delete(s.spenderIndex, spender)
+		changed = true
+
+		// A credit both created and spent within the rolled-back
+		// range was already removed by the credits loop above;
+		// only a credit that predates the rollback needs restoring
+		// to unspent, or it would be resurrected with a balance
+		// that should have been rolled back too.
+		if spent.credit.Height >= height {
+			continue
+		}
+		s.credits[spent.credit.Out] = spent.credit
+		// SpendCredit leaves the outpoint in creditsByAddr, so drop
+		// it before appending to keep it from being counted twice.
+		byAddr := removeOut(s.creditsByAddr[spent.credit.AddrHash], spent.credit.Out)
+		s.creditsByAddr[spent.credit.AddrHash] = append(byAddr, spent.credit.Out)
+		restored = append(restored, spent.credit.Out)
+	}
+
+	return changed, restored
+}
+
+// Credits returns every unspent credit currently held in the store.
+func (s *Store) Credits() []*Credit {
+	credits := make([]*Credit, 0, len(s.credits))
+	for _, c := range s.credits {
+		credits = append(credits, c)
+	}
+	return credits
+}
+
+// Record returns the transaction record stored under key, either a
+// *tx.RecvTx or a *tx.SendTx, or nil if key is not present.
+func (s *Store) Record(key TxKey) interface{} {
+	if rtx, ok := s.txs[key]; ok {
+		return rtx
+	}
+	if stx, ok := s.sends[key]; ok {
+		return stx
+	}
+	return nil
+}
+
+// RecordsForAddress returns every received transaction record paying
+// to addr's pubkey hash, using addrIndex rather than a full scan.
+func (s *Store) RecordsForAddress(addr btcutil.Address) []*tx.RecvTx {
+	var pkHash [btcwire.HashSize]byte
+	copy(pkHash[:], addr.ScriptAddress())
+
+	keys := s.addrIndex[pkHash]
+	records := make([]*tx.RecvTx, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, s.txs[key])
+	}
+	return records
+}
+
+func removeKey(keys []TxKey, key TxKey) []TxKey {
+	for i, k := range keys {
+		if k == key {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+func removeOut(outs []btcwire.OutPoint, out btcwire.OutPoint) []btcwire.OutPoint {
+	for i, o := range outs {
+		if o == out {
+			return append(outs[:i], outs[i+1:]...)
+		}
+	}
+	return outs
+}